@@ -37,6 +37,10 @@ class ClientHandler(Thread):
                 self.buffer = rest
                 s = l.split()
                 print s
+                if s == ['ok']:
+                    # reply to a command without a result (e.g. stepdown)
+                    wait_ack = False
+                    continue
                 if len(s) < 2:
                     continue
                 if s[0] == 'coordinator':
@@ -48,6 +52,9 @@ class ClientHandler(Thread):
                     wait_ack = False
                 elif s[0] == 'ack':
                     wait_ack = False
+                elif s[0] == 'err':
+                    sys.stderr.write(l + '\n')
+                    wait_ack = False
                 else:
                     print s
             else:
@@ -182,6 +189,8 @@ def main(debug=False):
             handler.start()
         elif cmd == 'get':
             send(pid, sp1[1], set_wait_ack=True)
+        elif cmd in ('stepdown', 'addServer', 'removeServer'):
+            send(pid, sp1[1], set_wait_ack=True)
         elif cmd == 'add' or cmd == 'delete':
             send(pid, sp1[1], set_wait_ack=True)
             for c in crash_later:
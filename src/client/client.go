@@ -0,0 +1,613 @@
+// Package client is a client library for the playlist servers. It speaks the
+// text protocol of their master-facing ports (see src/server), e.g.
+//
+//  c := client.New(map[int]string{0: "localhost:30000", 1: "localhost:30001"})
+//  defer c.Close()
+//
+//  txn, err := c.Add("song", "http://example.com/song")
+//  if abort, ok := err.(*client.AbortError); ok {
+//          // the transaction aborted (see abort.Reason and abort.Ids)
+//  } else if errors.Is(err, client.ErrUnavailable) {
+//          // no server could carry out the request
+//  }
+//
+// Requests are sent to the coordinator if it is known (and to any other server
+// otherwise, which forwards adds and deletes to the coordinator). The
+// coordinator is learned from the "coordinator <id>" notifications of the
+// servers and from their "not-coordinator" errors.
+//
+// Requests that fail because a server is unreachable, busy or timed out are
+// retried (on another server if there is one). Adds and deletes carry a request
+// id ("req=<id>"), so a retry gets the outcome of the transaction the original
+// request started (if any) instead of starting another one.
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"protocol"
+)
+
+const (
+	// Default time a request may take (transactions wait for the one in
+	// flight, if any)
+	DEFAULT_TIMEOUT = 10 * time.Second
+
+	// Default number of times a failed request is retried
+	DEFAULT_RETRIES = 3
+
+	// Delay between attempts to carry out a request (doubled after every
+	// attempt)
+	RETRY_BACKOFF = 100 * time.Millisecond
+)
+
+var (
+	// ErrUnavailable is returned (wrapped) when no server could carry out a
+	// request, e.g. because they are unreachable or no coordinator is alive
+	ErrUnavailable = errors.New("cluster unavailable")
+
+	// ErrNotFound is returned by Get if the song doesn't exist
+	ErrNotFound = errors.New("no such song")
+
+	// ErrClosed is returned for requests made after Close
+	ErrClosed = errors.New("client closed")
+)
+
+// AbortError is returned when a transaction aborted
+type AbortError struct {
+	Txn    string // id of the transaction (if known)
+	Reason string // why it aborted, e.g. "vote-no" or "timeout"
+	Ids    []int  // servers that caused the abort (if any)
+}
+
+func (e *AbortError) Error() string {
+	msg := "transaction aborted"
+	if e.Txn != "" {
+		msg += " (" + e.Txn + ")"
+	}
+	if e.Reason != "" {
+		msg += ": " + e.Reason
+	}
+	if len(e.Ids) > 0 {
+		msg += " by " + protocol.FormatIds(e.Ids)
+	}
+	return msg
+}
+
+// ServerError is returned when a server rejects a request (e.g. because an
+// argument is invalid), i.e. for an "err <code> <message>" reply
+type ServerError struct {
+	Code    string // e.g. "invalid-arg"
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// Client sends requests to the servers of a cluster
+//
+// A Client can be used by several goroutines at once.
+type Client struct {
+	Timeout time.Duration // time a request may take (DEFAULT_TIMEOUT if 0)
+	Retries int           // number of times a failed request is retried
+
+	servers     map[int]string // master-facing addresses by server id
+	coordinator int32          // id of the coordinator (-1 if unknown)
+	tag         uint64         // tag of the last request
+	id          string         // random id of the client (see nextRequestId)
+	reqs        uint64         // number of the last request id
+
+	// connects to a server (over TCP if nil, see dial)
+	dialer func(addr string, timeout time.Duration) (net.Conn, error)
+
+	conns  map[int]*conn // idle connections by server id
+	closed bool
+	mutex  sync.Mutex // mutex for accessing conns and closed
+}
+
+// New returns a client for the servers with the given master-facing
+// addresses (by id)
+func New(servers map[int]string) *Client {
+	c := &Client{
+		Retries:     DEFAULT_RETRIES,
+		servers:     make(map[int]string, len(servers)),
+		coordinator: -1,
+		conns:       make(map[int]*conn),
+	}
+	for id, addr := range servers {
+		c.servers[id] = addr
+	}
+
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		// fall back on the time, which is unique enough for one machine
+		now := time.Now().UnixNano()
+		for i := range id {
+			id[i] = byte(now >> (8 * uint(i)))
+		}
+	}
+	c.id = hex.EncodeToString(id[:])
+	return c
+}
+
+// Servers returns the ids of the servers of the client in ascending order
+func (c *Client) Servers() []int {
+	ids := make([]int, 0, len(c.servers))
+	for id := range c.servers {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// Coordinator returns the id of the coordinator (or -1 if it is unknown)
+func (c *Client) Coordinator() int {
+	return int(atomic.LoadInt32(&c.coordinator))
+}
+
+// Close closes the connections to the servers
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.closed = true
+	for id, cn := range c.conns {
+		cn.Close()
+		delete(c.conns, id)
+	}
+	return nil
+}
+
+// Get returns the url of the given song (or ErrNotFound)
+func (c *Client) Get(song string) (string, error) {
+	reply, err := c.do("get", song)
+	if err != nil {
+		return "", err
+	}
+
+	fields := strings.Fields(reply)
+	if len(fields) != 2 || fields[0] != "resp" {
+		return "", fmt.Errorf("unexpected reply: %q", reply)
+	} else if fields[1] == "NONE" {
+		return "", ErrNotFound
+	}
+	return fields[1], nil
+}
+
+// Add adds the given song (or updates its url) and returns the id of the
+// transaction
+//
+// Returns an *AbortError if the transaction aborted.
+func (c *Client) Add(song, url string) (string, error) {
+	reply, err := c.do("add", song, url, "req="+c.nextRequestId())
+	if err != nil {
+		return "", err
+	}
+	return parseOutcome(reply)
+}
+
+// Delete deletes the given song and returns the id of the transaction
+//
+// Returns an *AbortError if the transaction aborted.
+func (c *Client) Delete(song string) (string, error) {
+	reply, err := c.do("delete", song, "req="+c.nextRequestId())
+	if err != nil {
+		return "", err
+	}
+	return parseOutcome(reply)
+}
+
+// Op is an operation of a batch (see Batch)
+type Op struct {
+	Kind string // "get", "add" or "delete"
+	Song string
+	Url  string // url of the song to add
+}
+
+// Result is the result of an operation of a batch (see Batch)
+type Result struct {
+	Url string // url of the song (for "get")
+	Txn string // id of the transaction (for "add" and "delete")
+	Err error
+}
+
+// Batch carries out the given operations in order and returns their results
+//
+// NOTE: every operation is a transaction of its own, so the operations that
+// precede one that fails are not undone
+func (c *Client) Batch(ops []Op) []Result {
+	results := make([]Result, len(ops))
+	for i, op := range ops {
+		r := &results[i]
+		switch op.Kind {
+		case "get":
+			r.Url, r.Err = c.Get(op.Song)
+		case "add":
+			r.Txn, r.Err = c.Add(op.Song, op.Url)
+		case "delete":
+			r.Txn, r.Err = c.Delete(op.Song)
+		default:
+			r.Err = fmt.Errorf("unknown operation: %q", op.Kind)
+		}
+	}
+	return results
+}
+
+// Event is a notification from a server, e.g. {"coordinator", ["1"]} or
+// {"decision", ["commit", "add", "song", "url", "txn=1.0.15"]}
+type Event struct {
+	Server int      // id of the server that sent the notification
+	Kind   string   // "coordinator" or "decision"
+	Args   []string // arguments of the notification
+}
+
+// Watch returns the notifications of a server (the coordinator, if it is
+// known) until ctx is done, reconnecting to another server if the connection
+// is lost
+//
+// NOTE: every server notifies its own decisions, and only the coordinator
+// notifies that it became the coordinator
+func (c *Client) Watch(ctx context.Context) <-chan Event {
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+
+		backoff := RETRY_BACKOFF
+		for ctx.Err() == nil {
+			for _, id := range c.candidates() {
+				if c.watch(ctx, id, events) {
+					backoff = RETRY_BACKOFF
+				}
+				if ctx.Err() != nil {
+					return
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(backoff):
+				backoff *= 2
+			}
+		}
+	}()
+	return events
+}
+
+// watch writes the notifications of the server with the given id to events
+// until ctx is done or the connection is lost, and returns true if it
+// subscribed to them
+func (c *Client) watch(ctx context.Context, id int, events chan<- Event) bool {
+	cn, err := c.dial(id)
+	if err != nil {
+		return false
+	}
+	defer cn.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			cn.Close()
+		case <-stop:
+		}
+	}()
+
+	cn.SetDeadline(time.Now().Add(c.timeout()))
+	if _, err := cn.request(c.nextTag(), "subscribe notify"); err != nil {
+		return false
+	}
+	cn.SetDeadline(time.Time{})
+
+	for {
+		line, err := cn.r.ReadString('\n')
+		if err != nil {
+			return true
+		}
+		fields, err := protocol.SplitFields(strings.TrimSpace(line))
+		if err != nil || len(fields) < 2 || fields[0] != "notify" {
+			continue
+		}
+
+		event := Event{Server: id, Kind: fields[1], Args: fields[2:]}
+		c.notified(event)
+		select {
+		case events <- event:
+		case <-ctx.Done():
+			return true
+		}
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// requests                                                                  //
+///////////////////////////////////////////////////////////////////////////////
+
+// Exec sends the master command made of the given fields (e.g. "alive",
+// "phi") to the server with the given id and returns the reply, without
+// retrying
+//
+// Returns a *ServerError for an "err" reply.
+func (c *Client) Exec(id int, fields ...string) (string, error) {
+	reply, err := c.request(id, protocol.JoinFields(fields))
+	if err != nil {
+		return "", err
+	} else if err := parseError(reply); err != nil {
+		return "", err
+	}
+	return reply, nil
+}
+
+// do sends the command made of the given fields to the coordinator (or any
+// other server) and returns the reply, retrying if the request fails
+//
+// Returns a *ServerError for "err" replies that are not worth retrying.
+func (c *Client) do(fields ...string) (string, error) {
+	command := protocol.JoinFields(fields)
+
+	var lastErr error
+	backoff := RETRY_BACKOFF
+	for attempt := 0; attempt <= c.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		for _, id := range c.candidates() {
+			reply, err := c.request(id, command)
+			if err == ErrClosed {
+				return "", err
+			} else if err != nil {
+				lastErr = err
+				continue
+			}
+
+			err = parseError(reply)
+			switch err := err.(type) {
+			case nil:
+				return reply, nil
+			case *ServerError:
+				switch err.Code {
+				case "not-coordinator":
+					id, ok := protocol.ParseNotCoordinator(err.Message)
+					if !ok {
+						// try the next server
+						lastErr = err
+						continue
+					}
+					// try the coordinator first
+					c.setCoordinator(id)
+				case "busy", "timeout":
+				default:
+					return "", err
+				}
+			}
+			lastErr = err
+			break
+		}
+	}
+	return "", fmt.Errorf("%w: %v", ErrUnavailable, lastErr)
+}
+
+// request sends command to the server with the given id and returns its reply
+func (c *Client) request(id int, command string) (string, error) {
+	cn, err := c.get(id)
+	if err != nil {
+		return "", err
+	}
+
+	cn.SetDeadline(time.Now().Add(c.timeout()))
+	reply, err := cn.request(c.nextTag(), command)
+	if err != nil {
+		cn.Close()
+		return "", err
+	}
+	c.put(id, cn)
+	return reply, nil
+}
+
+// candidates returns the ids of the servers to send a request to, in order of
+// preference (the coordinator first)
+func (c *Client) candidates() []int {
+	coordinator := c.Coordinator()
+	ids := make([]int, 0, len(c.servers))
+	for id := range c.servers {
+		if id != coordinator {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	if _, ok := c.servers[coordinator]; ok {
+		ids = append([]int{coordinator}, ids...)
+	}
+	return ids
+}
+
+// notified updates the coordinator after a notification
+func (c *Client) notified(event Event) {
+	if event.Kind != "coordinator" || len(event.Args) != 1 {
+		return
+	}
+	if id, err := strconv.Atoi(event.Args[0]); err == nil {
+		c.setCoordinator(id)
+	}
+}
+
+func (c *Client) setCoordinator(id int) {
+	atomic.StoreInt32(&c.coordinator, int32(id))
+}
+
+func (c *Client) nextTag() string {
+	return "#" + strconv.FormatUint(atomic.AddUint64(&c.tag, 1), 10)
+}
+
+// nextRequestId returns a new id for an add or delete request, which is the
+// same for all of its attempts (see replayRequest in src/server)
+func (c *Client) nextRequestId() string {
+	return c.id + "." + strconv.FormatUint(atomic.AddUint64(&c.reqs, 1), 10)
+}
+
+func (c *Client) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return DEFAULT_TIMEOUT
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// connections                                                               //
+///////////////////////////////////////////////////////////////////////////////
+
+// conn is a connection to the master-facing port of a server
+type conn struct {
+	net.Conn
+	r      *bufio.Reader
+	client *Client
+	id     int // id of the server
+}
+
+// get returns an idle connection to the server with the given id (or a new
+// one)
+func (c *Client) get(id int) (*conn, error) {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return nil, ErrClosed
+	}
+	cn, ok := c.conns[id]
+	delete(c.conns, id)
+	c.mutex.Unlock()
+
+	if ok {
+		return cn, nil
+	}
+	return c.dial(id)
+}
+
+// put returns an idle connection to the server with the given id to the pool
+func (c *Client) put(id int, cn *conn) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.conns[id]; ok || c.closed {
+		cn.Close()
+		return
+	}
+	c.conns[id] = cn
+}
+
+// dial connects to the server with the given id
+func (c *Client) dial(id int) (*conn, error) {
+	addr, ok := c.servers[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown server %d", id)
+	}
+	dialer := c.dialer
+	if dialer == nil {
+		dialer = func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("tcp", addr, timeout)
+		}
+	}
+	nc, err := dialer(addr, c.timeout())
+	if err != nil {
+		return nil, err
+	}
+	return &conn{Conn: nc, r: bufio.NewReader(nc), client: c, id: id}, nil
+}
+
+// request sends command tagged with tag and returns the reply (without the
+// tag), handling the notifications that arrive in the meantime
+func (cn *conn) request(tag, command string) (string, error) {
+	if _, err := fmt.Fprintf(cn, "%s %s\n", tag, command); err != nil {
+		return "", err
+	}
+
+	for {
+		line, err := cn.r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimSpace(line)
+
+		if strings.HasPrefix(line, tag+" ") {
+			return strings.TrimPrefix(line, tag+" "), nil
+		} else if strings.HasPrefix(line, "#") {
+			// the reply to an earlier request that timed out
+			continue
+		}
+
+		// an unprefixed notification, e.g. "coordinator <id>"
+		fields := strings.Fields(line)
+		if len(fields) > 0 {
+			cn.client.notified(Event{Server: cn.id, Kind: fields[0], Args: fields[1:]})
+		}
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// replies                                                                   //
+///////////////////////////////////////////////////////////////////////////////
+
+// parseError returns the *ServerError of an "err <code> <message>" reply (or
+// nil for any other reply)
+func parseError(reply string) error {
+	parts := strings.SplitN(reply, " ", 3)
+	if parts[0] != "err" {
+		return nil
+	}
+
+	e := &ServerError{}
+	if len(parts) > 1 {
+		e.Code = parts[1]
+	}
+	if len(parts) > 2 {
+		e.Message = parts[2]
+	}
+	return e
+}
+
+// parseOutcome returns the transaction id of an "ack commit <details>" reply,
+// or an *AbortError for an "ack abort <details>" reply
+func parseOutcome(reply string) (string, error) {
+	fields := strings.Fields(reply)
+	if len(fields) < 2 || fields[0] != "ack" {
+		return "", fmt.Errorf("unexpected reply: %q", reply)
+	}
+
+	abort := &AbortError{}
+	for _, field := range fields[2:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "txn":
+			abort.Txn = kv[1]
+		case "reason":
+			abort.Reason = kv[1]
+		case "ids":
+			abort.Ids, _ = protocol.ParseIds(kv[1])
+		}
+	}
+
+	switch fields[1] {
+	case "commit":
+		return abort.Txn, nil
+	case "abort":
+		return abort.Txn, abort
+	}
+	return "", fmt.Errorf("unexpected reply: %q", reply)
+}
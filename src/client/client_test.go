@@ -0,0 +1,196 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"protocol"
+)
+
+// fakeCluster serves the master-facing ports of fake servers over net.Pipe
+type fakeCluster struct {
+	// handle returns the lines written in reply to a command with the given
+	// tag received by the server with the given id
+	handle func(id int, tag string, command []string) []string
+
+	commands []string // commands received so far, as "<id> <command>"
+	mutex    sync.Mutex
+}
+
+// newClient returns a client for the servers with the given ids
+func (fc *fakeCluster) newClient(ids ...int) *Client {
+	servers := make(map[int]string)
+	for _, id := range ids {
+		servers[id] = fmt.Sprint(id)
+	}
+	c := New(servers)
+	c.Timeout = time.Second
+	c.dialer = func(addr string, timeout time.Duration) (net.Conn, error) {
+		var id int
+		fmt.Sscan(addr, &id)
+		client, server := net.Pipe()
+		go fc.serve(id, server)
+		return client, nil
+	}
+	return c
+}
+
+func (fc *fakeCluster) serve(id int, conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+		tag, command := fields[0], fields[1]
+
+		fc.mutex.Lock()
+		fc.commands = append(fc.commands, fmt.Sprint(id, " ", command))
+		fc.mutex.Unlock()
+
+		args, _ := protocol.SplitFields(command)
+		for _, reply := range fc.handle(id, tag, args) {
+			if _, err := fmt.Fprintln(conn, reply); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (fc *fakeCluster) received() []string {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	return append([]string(nil), fc.commands...)
+}
+
+func TestRetryReplaysRequestId(t *testing.T) {
+	attempts := 0
+	fc := &fakeCluster{handle: func(id int, tag string, args []string) []string {
+		if attempts++; attempts < 3 {
+			return []string{tag + " err busy request is in progress"}
+		}
+		return []string{tag + " ack commit txn=0.0.1"}
+	}}
+	c := fc.newClient(0)
+	defer c.Close()
+
+	txn, err := c.Add("my song", "http://x")
+	if err != nil || txn != "0.0.1" {
+		t.Fatalf("Add = %q, %v, want \"0.0.1\", nil", txn, err)
+	}
+
+	commands := fc.received()
+	if len(commands) != 3 {
+		t.Fatalf("server received %q, want 3 attempts", commands)
+	}
+	for _, command := range commands {
+		if command != commands[0] || !strings.Contains(command, " req=") {
+			t.Errorf("attempts %q don't carry the same request id", commands)
+			break
+		}
+	}
+	if !strings.HasPrefix(commands[0], `0 add "my song" http://x req=`) {
+		t.Errorf("server received %q", commands[0])
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	fc := &fakeCluster{handle: func(id int, tag string, args []string) []string {
+		return []string{tag + " err timeout no coordinator"}
+	}}
+	c := fc.newClient(0)
+	c.Retries = 1
+	defer c.Close()
+
+	if _, err := c.Add("song", "http://x"); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Add = %v, want %v", err, ErrUnavailable)
+	}
+	if n := len(fc.received()); n != 2 {
+		t.Errorf("server received %d attempts, want 2", n)
+	}
+}
+
+func TestErrorsAreNotRetried(t *testing.T) {
+	fc := &fakeCluster{handle: func(id int, tag string, args []string) []string {
+		return []string{tag + " err invalid-arg invalid url: \"\""}
+	}}
+	c := fc.newClient(0, 1)
+	defer c.Close()
+
+	_, err := c.Add("song", "")
+	if e, ok := err.(*ServerError); !ok || e.Code != "invalid-arg" {
+		t.Errorf("Add = %v, want an invalid-arg *ServerError", err)
+	}
+	if n := len(fc.received()); n != 1 {
+		t.Errorf("servers received %d attempts, want 1", n)
+	}
+}
+
+func TestNotCoordinator(t *testing.T) {
+	tests := []struct {
+		reply       string
+		coordinator int
+	}{
+		{"err not-coordinator 2 the coordinator is 2", 2},
+		{"err not-coordinator -1 the coordinator is unknown", -1},
+		// from a server that doesn't name the coordinator
+		{"err not-coordinator the coordinator is 2", -1},
+	}
+
+	for _, test := range tests {
+		fc := &fakeCluster{handle: func(id int, tag string, args []string) []string {
+			if id == 2 {
+				return []string{tag + " ack commit txn=1.2.3"}
+			}
+			return []string{tag + " " + test.reply}
+		}}
+		c := fc.newClient(0, 1, 2)
+		c.Retries = 1
+
+		txn, err := c.Add("song", "http://x")
+		if err != nil || txn != "1.2.3" {
+			t.Errorf("%s: Add = %q, %v", test.reply, txn, err)
+		} else if c.Coordinator() != 2 && test.coordinator == 2 {
+			t.Errorf("%s: coordinator = %d, want 2", test.reply, c.Coordinator())
+		}
+
+		// the named coordinator is tried right after the first server
+		commands := fc.received()
+		if test.coordinator == 2 && (len(commands) != 2 || !strings.HasPrefix(commands[1], "2 ")) {
+			t.Errorf("%s: servers received %q", test.reply, commands)
+		}
+		c.Close()
+	}
+}
+
+func TestRequestMatchesTag(t *testing.T) {
+	fc := &fakeCluster{handle: func(id int, tag string, args []string) []string {
+		return []string{
+			"#0 resp http://stale",            // reply to an earlier request
+			"coordinator 1",                   // notification
+			"decision commit add a b txn=1.2", // notification
+			tag + "0 resp http://other",       // a tag that starts like ours
+			tag + " resp http://" + args[1],
+		}
+	}}
+	c := fc.newClient(0, 1)
+	defer c.Close()
+
+	for _, song := range []string{"a", "b"} {
+		url, err := c.Get(song)
+		if err != nil || url != "http://"+song {
+			t.Errorf("Get(%q) = %q, %v, want \"http://%s\", nil", song, url, err, song)
+		}
+	}
+	if c.Coordinator() != 1 {
+		t.Errorf("coordinator = %d after notification, want 1", c.Coordinator())
+	}
+}
@@ -0,0 +1,239 @@
+// Gencerts generates the certificates servers use to authenticate each other
+// with mutual TLS (see "server -tls <dir>"): a certificate authority for the
+// cluster and a certificate signed by it for every server.
+//
+// "gencerts -dir [dir] -n [numservers]" writes the following files to [dir]
+// for server ids {0...n-1}:
+//
+//  ca.pem, ca-key.pem                      the cluster's certificate authority
+//  server-<id>.pem, server-<id>-key.pem    the certificate and key of a server
+//
+// If [dir] already holds a certificate authority, it is reused, so that
+// certificates for servers that join the cluster later can be added with e.g.
+// "gencerts -dir [dir] -ids 3,4".
+//
+// NOTE: copy ca.pem and the server's own certificate and key to each server,
+// but keep ca-key.pem to yourself.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Constants for printing error messages to the terminal
+	BOLD_RED = "\033[31;1m"
+	NO_STYLE = "\033[0m"
+	ERROR    = "[" + BOLD_RED + "ERROR" + NO_STYLE + "]"
+
+	// How long certificates are valid for
+	VALIDITY = 10 * 365 * 24 * time.Hour
+)
+
+var (
+	DIR       = "certs" // output directory
+	NUM_PROCS = 0       // generate certificates for ids {0...n-1}
+	IDS       string    // generate certificates for these (comma-separated) ids
+)
+
+func main() {
+	flag.StringVar(&DIR, "dir", DIR, "output `directory`")
+	flag.IntVar(&NUM_PROCS, "n", NUM_PROCS,
+		"generate certificates for servers {0...n-1}")
+	flag.StringVar(&IDS, "ids", "",
+		"generate certificates for the given comma-separated server `ids`")
+	flag.Parse()
+
+	ids, err := parseIds()
+	if err != nil {
+		Fatal(err)
+	} else if len(ids) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := os.MkdirAll(DIR, 0700); err != nil {
+		Fatal(err)
+	}
+
+	ca, caKey, err := loadOrCreateCA()
+	if err != nil {
+		Fatal("certificate authority: ", err)
+	}
+
+	for _, id := range ids {
+		name := fmt.Sprintf("server-%d", id)
+		if err := createCert(name, ca, caKey); err != nil {
+			Fatal(name, ": ", err)
+		}
+		fmt.Println("wrote", filepath.Join(DIR, name+".pem"))
+	}
+}
+
+// parseIds returns the ids given by the -n and -ids flags
+func parseIds() ([]int, error) {
+	var ids []int
+	for id := 0; id < NUM_PROCS; id++ {
+		ids = append(ids, id)
+	}
+
+	if IDS == "" {
+		return ids, nil
+	}
+	for _, arg := range strings.Split(IDS, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(arg))
+		if err != nil || id < 0 {
+			return nil, errors.New("invalid server id: \"" + arg + "\"")
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// loadOrCreateCA returns the certificate authority in DIR, creating one if
+// there is none
+func loadOrCreateCA() (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certFile := filepath.Join(DIR, "ca.pem")
+	keyFile := filepath.Join(DIR, "ca-key.pem")
+
+	if _, err := os.Stat(certFile); err == nil {
+		cert, err := readPEM(certFile, "CERTIFICATE")
+		if err != nil {
+			return nil, nil, err
+		}
+		key, err := readPEM(keyFile, "EC PRIVATE KEY")
+		if err != nil {
+			return nil, nil, err
+		}
+
+		ca, err := x509.ParseCertificate(cert)
+		if err != nil {
+			return nil, nil, err
+		}
+		caKey, err := x509.ParseECPrivateKey(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		return ca, caKey, nil
+	}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := newTemplate("three-phase-commit cluster CA")
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := writeKey(keyFile, caKey); err != nil {
+		return nil, nil, err
+	}
+	if err := writePEM(certFile, "CERTIFICATE", der, 0644); err != nil {
+		return nil, nil, err
+	}
+	fmt.Println("wrote", certFile)
+	return ca, caKey, nil
+}
+
+// createCert writes a certificate (signed by the given certificate authority)
+// and private key for a server whose certificate is issued to the given name
+func createCert(name string, ca *x509.Certificate, caKey *ecdsa.PrivateKey) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	template := newTemplate(name)
+	template.DNSNames = []string{name}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{
+		x509.ExtKeyUsageServerAuth, // servers accept connections...
+		x509.ExtKeyUsageClientAuth, // ...and dial each other
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca,
+		&key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+
+	if err := writeKey(filepath.Join(DIR, name+"-key.pem"), key); err != nil {
+		return err
+	}
+	return writePEM(filepath.Join(DIR, name+".pem"), "CERTIFICATE", der, 0644)
+}
+
+// newTemplate returns a certificate template for the given common name
+func newTemplate(name string) *x509.Certificate {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		Fatal(err)
+	}
+
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(VALIDITY),
+	}
+}
+
+func writeKey(path string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return writePEM(path, "EC PRIVATE KEY", der, 0600)
+}
+
+func writePEM(path, typ string, der []byte, mode os.FileMode) error {
+	data := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	return ioutil.WriteFile(path, data, mode)
+}
+
+func readPEM(path, typ string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != typ {
+		return nil, errors.New(path + ": no " + typ + " found")
+	}
+	return block.Bytes, nil
+}
+
+// Fail logs the given error and exits with status 1
+func Fatal(err ...interface{}) {
+	log.Fatalln(ERROR + " " + fmt.Sprint(err...))
+}
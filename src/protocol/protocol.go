@@ -0,0 +1,109 @@
+// Package protocol holds the parts of the text protocol of the servers'
+// master-facing ports (see src/server) that the servers and their clients (see
+// src/client and src/tpcctl) have in common: how commands are split into
+// fields, and how lists of server ids are written.
+//
+// Fields are separated by runs of whitespace. A field that is empty or
+// contains whitespace or double quotes is written as a double-quoted string
+// (see strconv.Quote), e.g. `add "my song" http://example.com`.
+package protocol
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// QuoteField returns s quoted (see strconv.Quote) if it is empty or contains
+// whitespace or double quotes, so that SplitFields returns it as one field
+func QuoteField(s string) string {
+	if s == "" || strings.IndexFunc(s, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '"'
+	}) >= 0 {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// JoinFields returns the command made of the given fields (see QuoteField)
+func JoinFields(fields []string) string {
+	quoted := make([]string, len(fields))
+	for i, field := range fields {
+		quoted[i] = QuoteField(field)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// SplitFields splits s around runs of whitespace, treating a double-quoted
+// string (see strconv.Quote) as one field, e.g. `add "my song" url` is split
+// into "add", "my song" and "url"
+func SplitFields(s string) ([]string, error) {
+	var fields []string
+	for {
+		s = strings.TrimLeftFunc(s, unicode.IsSpace)
+		if s == "" {
+			return fields, nil
+		}
+
+		if s[0] == '"' {
+			quoted, err := strconv.QuotedPrefix(s)
+			if err != nil {
+				return nil, err
+			}
+			field, _ := strconv.Unquote(quoted)
+			fields = append(fields, field)
+			s = s[len(quoted):]
+			continue
+		}
+
+		end := strings.IndexFunc(s, unicode.IsSpace)
+		if end == -1 {
+			end = len(s)
+		}
+		fields = append(fields, s[:end])
+		s = s[end:]
+	}
+}
+
+// FormatIds returns the given ids as a comma-separated list (e.g. "0,1,2")
+func FormatIds(ids []int) string {
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = strconv.Itoa(id)
+	}
+	return strings.Join(strs, ",")
+}
+
+// ParseIds parses a comma-separated list of ids (see FormatIds)
+func ParseIds(s string) ([]int, error) {
+	var ids []int
+	for _, str := range strings.Split(s, ",") {
+		id, err := strconv.Atoi(str)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// NotCoordinator returns the message of a "not-coordinator" error, which
+// starts with the id of the coordinator (-1 if it is unknown) so that clients
+// can follow it, e.g. "1 the coordinator is 1"
+func NotCoordinator(coordinator int, reason string) string {
+	return strconv.Itoa(coordinator) + " " + reason
+}
+
+// ParseNotCoordinator returns the id of the coordinator carried by the message
+// of a "not-coordinator" error (see NotCoordinator), and false if it is unknown
+func ParseNotCoordinator(msg string) (int, bool) {
+	fields := strings.Fields(msg)
+	if len(fields) == 0 {
+		return -1, false
+	}
+	id, err := strconv.Atoi(fields[0])
+	if err != nil || id < 0 {
+		return -1, false
+	}
+	return id, true
+}
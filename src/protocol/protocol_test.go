@@ -0,0 +1,122 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitFields(t *testing.T) {
+	tests := []struct {
+		s      string
+		fields []string
+		err    bool
+	}{
+		{"", nil, false},
+		{"   \t ", nil, false},
+		{"get song", []string{"get", "song"}, false},
+		{"  add\tsong  url \n", []string{"add", "song", "url"}, false},
+		{`add "my song" url`, []string{"add", "my song", "url"}, false},
+		{`add "" url`, []string{"add", "", "url"}, false},
+		{`add "say \"hi\"" url`, []string{"add", `say "hi"`, "url"}, false},
+		{`add "tab\tnewline\n" url`, []string{"add", "tab\tnewline\n", "url"}, false},
+		{"add café http://x/ü", []string{"add", "café", "http://x/ü"}, false},
+		{`add "日本 の 歌" url`, []string{"add", "日本 の 歌", "url"}, false},
+		{`get "unterminated`, nil, true},
+		{`get "bad \q escape"`, nil, true},
+	}
+
+	for _, test := range tests {
+		fields, err := SplitFields(test.s)
+		if (err != nil) != test.err {
+			t.Errorf("SplitFields(%q): error = %v, want error: %v", test.s, err, test.err)
+		} else if !reflect.DeepEqual(fields, test.fields) {
+			t.Errorf("SplitFields(%q) = %q, want %q", test.s, fields, test.fields)
+		}
+	}
+}
+
+func TestQuoteField(t *testing.T) {
+	tests := []struct {
+		s, quoted string
+	}{
+		{"song", "song"},
+		{"café", "café"},
+		{"", `""`},
+		{"my song", `"my song"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{"a\tb", `"a\tb"`},
+		{"日本 の 歌", `"日本 の 歌"`},
+	}
+
+	for _, test := range tests {
+		if quoted := QuoteField(test.s); quoted != test.quoted {
+			t.Errorf("QuoteField(%q) = %s, want %s", test.s, quoted, test.quoted)
+		}
+	}
+}
+
+func TestJoinFieldsRoundTrip(t *testing.T) {
+	tests := [][]string{
+		{"get", "song"},
+		{"add", "my song", "http://example.com/a b"},
+		{"add", "", `"`},
+		{"add", "café ☕", "http://example.com/ü"},
+		{"add", "日本 の 歌", " "},
+		{"delete", "line\nbreak"},
+	}
+
+	for _, fields := range tests {
+		command := JoinFields(fields)
+		split, err := SplitFields(command)
+		if err != nil {
+			t.Errorf("SplitFields(%q): %v", command, err)
+		} else if !reflect.DeepEqual(split, fields) {
+			t.Errorf("SplitFields(JoinFields(%q)) = %q", fields, split)
+		}
+	}
+}
+
+func TestParseIds(t *testing.T) {
+	tests := []struct {
+		s   string
+		ids []int
+		err bool
+	}{
+		{"0", []int{0}, false},
+		{"0,1,2", []int{0, 1, 2}, false},
+		{"", nil, true},
+		{"0,,2", nil, true},
+		{"0,x", nil, true},
+	}
+
+	for _, test := range tests {
+		ids, err := ParseIds(test.s)
+		if (err != nil) != test.err {
+			t.Errorf("ParseIds(%q): error = %v, want error: %v", test.s, err, test.err)
+		} else if !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("ParseIds(%q) = %v, want %v", test.s, ids, test.ids)
+		} else if !test.err && FormatIds(ids) != test.s {
+			t.Errorf("FormatIds(%v) = %q, want %q", ids, FormatIds(ids), test.s)
+		}
+	}
+}
+
+func TestParseNotCoordinator(t *testing.T) {
+	tests := []struct {
+		msg string
+		id  int
+		ok  bool
+	}{
+		{NotCoordinator(1, "the coordinator is 1"), 1, true},
+		{NotCoordinator(-1, "the coordinator is unknown"), -1, false},
+		{"the coordinator is 1", -1, false},
+		{"", -1, false},
+	}
+
+	for _, test := range tests {
+		if id, ok := ParseNotCoordinator(test.msg); id != test.id || ok != test.ok {
+			t.Errorf("ParseNotCoordinator(%q) = %d, %v, want %d, %v",
+				test.msg, id, ok, test.id, test.ok)
+		}
+	}
+}
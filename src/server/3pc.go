@@ -1,24 +1,37 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
-	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
+	"unicode"
+
+	"protocol"
 )
 
-func execute(conn net.Conn, command string) {
-	args := strings.Split(command, " ")
+// execute runs the given master command and writes exactly one terminal
+// response to s (see master.go), except for "crash", which exits
+func execute(s *masterSession, command string) {
+	args, err := protocol.SplitFields(command)
+	if err != nil {
+		replyError(s, ERR_MALFORMED, "cannot parse command: ", err)
+		return
+	} else if len(args) == 0 {
+		// e.g. an empty line or a tag alone ("#7")
+		replyError(s, ERR_MALFORMED, "empty command")
+		return
+	}
 	argLengthAtLeast := func(min int) bool {
 		if len(args) < min {
-			Error("not enough arguments to ",
-				args[0], " command: \"", command, "\"")
+			replyError(s, ERR_MISSING_ARGS, "not enough arguments to ", args[0])
 			return false
 		}
 		return true
@@ -26,22 +39,85 @@ func execute(conn net.Conn, command string) {
 
 	switch args[0] {
 	case "get":
-		if argLengthAtLeast(2) {
-			getCoordinator(conn, args[1])
+		if argLengthAtLeast(2) && validSong(s, args[1]) {
+			getCoordinator(s, args[1])
 		}
 	case "delete":
-		// TODO: maybe remove COORDINATOR check
-		if COORDINATOR == ID && argLengthAtLeast(2) {
-			deleteCoordinator(args[1:])
+		if argLengthAtLeast(2) && validSong(s, args[1]) && validRequestId(s, args, 2) {
+			forward(s, args)
 		}
 	case "add":
-		// TODO: maybe remove COORDINATOR check
-		if COORDINATOR == ID && argLengthAtLeast(3) {
-			addCoordinator(args[1:])
+		if argLengthAtLeast(3) && validSong(s, args[1]) && validUrl(s, args[2]) &&
+			validRequestId(s, args, 3) {
+			forward(s, args)
+		}
+	case "addServer":
+		if argLengthAtLeast(2) && isCoordinator(s) {
+			addServerCoordinator(s, args[1])
+		}
+	case "removeServer":
+		if argLengthAtLeast(2) && isCoordinator(s) {
+			removeServerCoordinator(s, args[1])
 		}
+	case "stepdown":
+		target := -1
+		if len(args) > 1 {
+			if target, err = strconv.Atoi(args[1]); err != nil {
+				replyError(s, ERR_INVALID_ARG, "invalid stepdown target: ", protocol.QuoteField(args[1]))
+				break
+			}
+		}
+		if isCoordinator(s) {
+			stepDown(s, target)
+		}
+
+	case "messages":
+		writeMessages(s)
+	case "alive":
+		writeAlive(s, len(args) > 1 && args[1] == "phi")
+	case "broadcast":
+		if argLengthAtLeast(2) {
+			// the message is the rest of the command (spaces included)
+			msg := strings.TrimSpace(strings.TrimPrefix(command, args[0]))
+			broadcast(newMessage(msg))
+			fmt.Fprintln(s, "ok")
+		}
+
+	case "subscribe":
+		Masters.Subscribe(s, true, len(args) > 1 && args[1] == "notify")
+		fmt.Fprintln(s, "ok")
+	case "unsubscribe":
+		Masters.Subscribe(s, false, false)
+		fmt.Fprintln(s, "ok")
 
-	case "crash":
+	case "metrics":
+		fmt.Fprintln(s, "metrics", Metrics.String())
+	case "suspicion":
+		fmt.Fprintln(s, "suspicion", LastTimestamp.Suspicions(time.Now()))
+	case "clock":
+		fmt.Fprintln(s, "clock", LastTimestamp.Clocks())
+
+	case "crash", "crashAfterVote", "crashBeforeVote", "crashAfterAck",
+		"crashVoteREQ", "crashPartialPreCommit", "crashPartialCommit":
+		setCrashPoint(s, args)
+
+	default:
+		replyError(s, ERR_UNKNOWN_COMMAND, "unrecognized command: ", protocol.QuoteField(args[0]))
+	}
+}
+
+// setCrashPoint runs the crash command args (e.g. "crashVoteREQ 1 2") and
+// writes "ok" to w, except for those that crash right away (see crashesNow),
+// which exit
+//
+// NOTE: the other crash points are stubs (see crashAfterVote), so they are
+// answered with "err not-implemented" instead, rather than pretending to be set
+func setCrashPoint(w io.Writer, args []string) {
+	if crashesNow(args) {
 		crash()
+	}
+
+	switch args[0] {
 	case "crashAfterVote":
 		crashAfterVote()
 	case "crashBeforeVote":
@@ -54,10 +130,9 @@ func execute(conn net.Conn, command string) {
 			switch args[0] {
 			case "crashVoteREQ":
 			case "crashPartialPreCommit":
-			case "crashPartialCommit":
-				crash()
 			default:
-				Error("unrecognized command: \"", command, "\"")
+				replyError(w, ERR_UNKNOWN_COMMAND, "unrecognized crash point: ", protocol.QuoteField(args[0]))
+				return
 			}
 		} else {
 			switch args[0] {
@@ -68,10 +143,64 @@ func execute(conn net.Conn, command string) {
 			case "crashPartialCommit":
 				crashPartialCommit(args[1:])
 			default:
-				Error("unrecognized command: \"", command, "\"")
+				replyError(w, ERR_UNKNOWN_COMMAND, "unrecognized crash point: ", protocol.QuoteField(args[0]))
+				return
 			}
 		}
 	}
+	replyError(w, ERR_NOT_IMPLEMENTED, "crash point not implemented: ", protocol.QuoteField(args[0]))
+}
+
+// crashesNow returns true if the crash command args makes this server crash
+// right away (i.e. "crash", or "crashPartialCommit" without arguments)
+func crashesNow(args []string) bool {
+	return args[0] == "crash" || (args[0] == "crashPartialCommit" && len(args) == 1)
+}
+
+// validSong returns true if song is a valid song name (and replies with an
+// error otherwise)
+func validSong(w io.Writer, song string) bool {
+	if song == "" || strings.IndexFunc(song, unicode.IsControl) >= 0 {
+		replyError(w, ERR_INVALID_ARG, "invalid song: ", protocol.QuoteField(song))
+		return false
+	}
+	return true
+}
+
+// validUrl returns true if url is a valid url (and replies with an error
+// otherwise)
+//
+// NOTE: urls are written to the master unquoted (see getCoordinator), so they
+// can't contain whitespace, and "NONE" stands for a song that doesn't exist
+func validUrl(w io.Writer, url string) bool {
+	if url == "" || url == "NONE" || strings.IndexFunc(url, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	}) >= 0 {
+		replyError(w, ERR_INVALID_ARG, "invalid url: ", protocol.QuoteField(url))
+		return false
+	}
+	return true
+}
+
+// requestId returns the id of the client request carried by the "req=<id>"
+// field that follows the n arguments of a command (e.g. "add <song> <url>
+// req=<id>"), and false if there is none (see replayRequest)
+func requestId(args []string, n int) (string, bool) {
+	if len(args) > n && strings.HasPrefix(args[n], "req=") {
+		return strings.TrimPrefix(args[n], "req="), true
+	}
+	return "", false
+}
+
+// validRequestId returns true if the command args doesn't carry a request id,
+// or carries a valid one (and replies with an error otherwise)
+func validRequestId(w io.Writer, args []string, n int) bool {
+	req, ok := requestId(args, n)
+	if ok && (req == "" || strings.IndexFunc(req, unicode.IsControl) >= 0) {
+		replyError(w, ERR_INVALID_ARG, "invalid request id: ", protocol.QuoteField(req))
+		return false
+	}
+	return true
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -141,111 +270,252 @@ type response struct {
 	id int
 }
 
+// Reasons for aborting a transaction (see outcome)
+const (
+	ABORT_VOTE_NO        = "vote-no"        // a server (possibly the coordinator) voted no
+	ABORT_TIMEOUT        = "timeout"        // a participant failed to vote in time
+	ABORT_UNSUPPORTED    = "unsupported"    // a participant doesn't support membership changes
+	ABORT_STATE_TRANSFER = "state-transfer" // a joining server failed to receive the state
+	ABORT_NOT_ALIVE      = "not-alive"      // the server to add is not alive
+	ABORT_TERMINATION    = "termination"    // the termination protocol aborted
+)
+
+// outcome is the decision of a transaction, as reported to the master (e.g.
+// "ack abort txn=1.0.15 reason=vote-no ids=2") and recorded in the DT log (see
+// writeDecision)
+type outcome struct {
+	Txn    string // id of the transaction (if known)
+	Commit bool
+	Reason string // why the transaction aborted (see ABORT_VOTE_NO etc.)
+	Ids    []int  // servers that caused the abort (if any)
+}
+
+// fields returns the decision ("commit" or "abort") followed by the details of
+// the outcome as <key>=<value> fields
+func (o outcome) fields() []string {
+	if o.Commit {
+		fields := []string{"commit"}
+		if o.Txn != "" {
+			fields = append(fields, "txn="+o.Txn)
+		}
+		return fields
+	}
+
+	fields := []string{"abort"}
+	if o.Txn != "" {
+		fields = append(fields, "txn="+o.Txn)
+	}
+	fields = append(fields, "reason="+o.Reason)
+	if len(o.Ids) > 0 {
+		fields = append(fields, "ids="+protocol.FormatIds(o.Ids))
+	}
+	return fields
+}
+
+func (o outcome) String() string {
+	return strings.Join(o.fields(), " ")
+}
+
+// writeDecision writes the commit or abort record of the given operation to
+// the DT log, followed by the details of the outcome (e.g. "abort add song url
+// txn=1.0.15 reason=vote-no ids=2")
+//
+// NOTE: the details come after the arguments of the operation, so the records
+// are still looked up by their first three fields (see
+// readVoteOrDecisionFromLog)
+func writeDecision(op Operation, o outcome) {
+	fields := o.fields()
+	args := op.args()
+	for _, field := range fields[1:] {
+		args = append(args, field)
+	}
+	writeToDtLog(fields[0]+" "+op.Kind, args...)
+}
+
+// replayRequest writes the outcome of the transaction of the client request
+// with the given id to w (e.g. "ack commit txn=<txn>") and returns true, if the
+// request was already received, so that a retried request isn't carried out
+// twice. A request whose transaction hasn't been decided yet is answered with a
+// "busy" error (and should be retried later), and one whose id was used for a
+// different operation (e.g. another song) with an "invalid-arg" error.
+//
+// NOTE: the coordinator and the participants record the transaction of each
+// request in the DT log ("request <req> <txn>"), so a new coordinator answers
+// the requests received by the old one. A request whose transaction never got
+// a vote from this server (e.g. because the old coordinator failed before it
+// sent the VOTE-REQ) is carried out again.
+func replayRequest(w io.Writer, req string, op Operation) bool {
+	txn, ok := readRequestFromLog(req)
+	if !ok {
+		return false
+	}
+
+	record, ok := readTxnFromLog(txn)
+	logged, inFlight := InFlight.Copy()[txn]
+	if ok && len(record) >= 3 {
+		logged, _ = parseRecord(record)
+	}
+	if (ok && len(record) >= 3 || inFlight) && !sameOperation(logged, op) {
+		replyError(w, ERR_INVALID_ARG, "request ", protocol.QuoteField(req),
+			" was already used for another operation (transaction ", txn, ")")
+		return true
+	}
+
+	switch {
+	case ok && len(record) >= 3 && (record[0] == "commit" || record[0] == "abort"):
+		_, details := parseRecord(record)
+		fmt.Fprintln(w, "ack", strings.Join(append(record[:1:1], details...), " "))
+	case ok || inFlight:
+		replyError(w, ERR_BUSY, "request ", protocol.QuoteField(req), " is in progress (transaction ",
+			txn, ")")
+	default:
+		return false
+	}
+	return true
+}
+
+// sameOperation returns true if a and b make the same change (regardless of
+// their request ids)
+func sameOperation(a, b Operation) bool {
+	return a.Kind == b.Kind && a.Song == b.Song && a.Url == b.Url && a.Config == b.Config
+}
+
+// noVoters returns the ids of the participants that voted no
+func noVoters(resps []response) []int {
+	var ids []int
+	for _, resp := range resps {
+		if resp.v != "yes" {
+			ids = append(ids, resp.id)
+		}
+	}
+	return ids
+}
+
+// silentParticipants returns the ids of the participants (other than this
+// server) that didn't respond
+func silentParticipants(participants []int, resps []response) []int {
+	responded := make(map[int]bool)
+	for _, resp := range resps {
+		responded[resp.id] = true
+	}
+
+	var ids []int
+	for _, id := range participants {
+		if id != ID && !responded[id] {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
 // TODO
-func getCoordinator(conn net.Conn, song string) {
+func getCoordinator(w io.Writer, song string) {
 	// check the local playlist
 	url := LocalPlaylist.GetSongUrl(song)
 
 	// ask other servers for the song url (if this server doesn't have it)
 	if url == "NONE" {
-		m := newMessage("get " + song)
-		mBytes, err := json.Marshal(m)
-		if err != nil {
-			Error("failed to create message: \"", "get ", song, "\"")
-			return
-		}
-		mJson := string(mBytes)
-
-		for id := 0; id < NUM_PROCS; id++ {
+		for _, id := range Members.Ids() {
 			if id == ID {
 				continue
 			}
 
-			resp, err := sendAndWaitForResponse(mJson, id)
+			resp, err := sendAndWaitForResponse(&Get{Song: song}, id)
 			if err != nil {
 				continue
 			}
 
-			args := strings.Split(string(resp), " ")
-			if len(args) >= 2 {
-				if args[0] == "resp" && args[1] != "NONE" {
-					url = string(args[1])
-					LocalPlaylist.AddOrUpdateSong(song, url)
-					// TODO: Write the new value to the DT
-					// log?
-					//
-					// MAYBE NOT because you might get a
-					// value that is about to be removed in
-					// a current commit and then you'll
-					// create an inconsistent state
-					break
-				}
+			if resp, ok := resp.(*GetResp); ok && resp.Url != "NONE" {
+				url = resp.Url
+				LocalPlaylist.AddOrUpdateSong(song, url)
+				// TODO: Write the new value to the DT
+				// log?
+				//
+				// MAYBE NOT because you might get a
+				// value that is about to be removed in
+				// a current commit and then you'll
+				// create an inconsistent state
+				break
 			}
 		}
 	}
 
-	conn.SetWriteDeadline(time.Now().Add(TIMEOUT))
-	fmt.Fprintln(conn, "resp", url)
+	fmt.Fprintln(w, "resp", url)
 }
 
 // TODO
-func addCoordinator(args []string) {
+func addCoordinator(w io.Writer, args []string, req string) {
+	TxnMutex.Lock()
+	defer TxnMutex.Unlock()
+	if !isCoordinator(w) {
+		return
+	}
+
+	// answer a retried request with the outcome of its transaction
+	if req != "" && replayRequest(w, req, Operation{Kind: "add", Song: args[0], Url: args[1]}) {
+		return
+	}
+
 	song := args[0]
 	url := args[1]
 	coordinatorVote := vote(url)
 
+	txn := newTxnId()
+	op := Operation{Kind: "add", Song: song, Url: url, Req: req}
+	if req != "" {
+		writeToDtLog("request", req, txn)
+	}
+
 	// TODO: maybe write start-3pc first
 	// abort immediately if the coordinator votes no
 	if coordinatorVote == "no" {
-		MessagesToMaster.Enqueue("ack abort")
+		o := outcome{Txn: txn, Reason: ABORT_VOTE_NO, Ids: []int{ID}}
+		writeDecision(op, o)
+		fmt.Fprintln(w, "ack", o)
 		return
 	}
 
+	InFlight.Add(txn, op)
+	defer InFlight.Remove(txn)
+
 	// write start-3pc record in DT log
 	writeToDtLog("start-3pc add", song, url)
 
 	// send VOTE-REQ to all participants
 	// AND wait for vote messages from all participants
-	resps, err, timeout := broadcastToParticipantsAndAwaitResponses(
-		fmt.Sprintf("vote-req add %s %s", song, url))
-	if timeout {
+	participants := LastTimestamp.GetAlive(time.Now())
+	resps, err, timeout := broadcastAndAwaitResponses(participants,
+		&VoteReq{Txn: txn, Op: op})
+	if timeout || err != nil {
 		// write abort record in DT log
-		writeToDtLog("abort add", song, url)
+		o := outcome{Txn: txn, Reason: ABORT_TIMEOUT,
+			Ids: silentParticipants(participants, resps)}
+		writeDecision(op, o)
 
 		// send abort to all processes that voted yes
 		sendAbortToYesVoters(resps)
 
 		// send abort to master
-		MessagesToMaster.Enqueue("ack abort")
-		return
-	} else if err != nil {
-		// TODO: COMBINE THIS WITH THE PREVIOUS CHECK AND DO LIKEWISE
-		// FOR THE REST OF THIS FILE
-		Error(err)
+		fmt.Fprintln(w, "ack", o)
 		return
 	}
 
-	// check that all participants voted yes
-	allVotedYes := true
-	for _, resp := range resps {
-		if resp.v != "yes" {
-			allVotedYes = false
-			break
+	if noVoters := noVoters(resps); len(noVoters) == 0 {
+		// send pre-commit to all participants (2PC has no pre-commit
+		// round)
+		if PROTOCOL == "3pc" {
+			sendToParticipantsAndAwaitAcks(resps, &PreCommit{})
 		}
-	}
-
-	if allVotedYes {
-		// send pre-commit to all participants
-		sendToParticipantsAndAwaitAcks(resps, "pre-commit")
 
 		// write commit record to DT log
-		writeToDtLog("commit add", song, url)
+		o := outcome{Txn: txn, Commit: true}
+		writeDecision(op, o)
 
 		// send commit to all participants
-		sendToParticipants(resps, "commit")
+		sendToParticipants(resps, &Decision{Commit: true})
 
 		// send commit to master
-		MessagesToMaster.Enqueue("ack commit")
+		fmt.Fprintln(w, "ack", o)
 
 		// add song to local playlist
 		LocalPlaylist.AddOrUpdateSong(song, url)
@@ -253,85 +523,338 @@ func addCoordinator(args []string) {
 		// some participant voted no
 
 		// write abort record in DT log
-		writeToDtLog("abort add", song, url)
+		o := outcome{Txn: txn, Reason: ABORT_VOTE_NO, Ids: noVoters}
+		writeDecision(op, o)
 
 		// send abort to all processes that voted yes
 		sendAbortToYesVoters(resps)
 
 		// send abort to master
-		MessagesToMaster.Enqueue("ack abort")
+		fmt.Fprintln(w, "ack", o)
 	}
-
-	return
 }
 
 // TODO
-func deleteCoordinator(args []string) {
+func deleteCoordinator(w io.Writer, args []string, req string) {
+	TxnMutex.Lock()
+	defer TxnMutex.Unlock()
+	if !isCoordinator(w) {
+		return
+	}
+
+	// answer a retried request with the outcome of its transaction
+	if req != "" && replayRequest(w, req, Operation{Kind: "delete", Song: args[0]}) {
+		return
+	}
+
 	song := args[0]
 
+	txn := newTxnId()
+	op := Operation{Kind: "delete", Song: song, Req: req}
+	if req != "" {
+		writeToDtLog("request", req, txn)
+	}
+	InFlight.Add(txn, op)
+	defer InFlight.Remove(txn)
+
 	// write start-3pc record in DT log
 	writeToDtLog("start-3pc delete", song)
 
 	// send VOTE-REQ to all participants
 	// AND wait for vote messages from all participants
-	resps, err, timeout := broadcastToParticipantsAndAwaitResponses(
-		"vote-req delete " + song)
-	if timeout {
+	participants := LastTimestamp.GetAlive(time.Now())
+	resps, err, timeout := broadcastAndAwaitResponses(participants,
+		&VoteReq{Txn: txn, Op: op})
+	if timeout || err != nil {
 		// write abort record in DT log
-		writeToDtLog("abort delete", song)
+		o := outcome{Txn: txn, Reason: ABORT_TIMEOUT,
+			Ids: silentParticipants(participants, resps)}
+		writeDecision(op, o)
 
 		// send abort to all processes that voted yes
 		sendAbortToYesVoters(resps)
 
 		// send abort to master
-		MessagesToMaster.Enqueue("ack abort")
-		return
-	} else if err != nil {
-		Error(err)
+		fmt.Fprintln(w, "ack", o)
 		return
 	}
 
-	// check that all participants voted yes
-	allVotedYes := true
-	for _, resp := range resps {
-		if resp.v != "yes" {
-			allVotedYes = false
-			break
+	if noVoters := noVoters(resps); len(noVoters) == 0 {
+		// send pre-commit to all participants (2PC has no pre-commit
+		// round)
+		if PROTOCOL == "3pc" {
+			sendToParticipantsAndAwaitAcks(resps, &PreCommit{})
 		}
-	}
-
-	if allVotedYes {
-		// send pre-commit to all participants
-		sendToParticipantsAndAwaitAcks(resps, "pre-commit")
 
 		// write commit record to DT log
-		writeToDtLog("commit delete", song)
+		o := outcome{Txn: txn, Commit: true}
+		writeDecision(op, o)
 
 		// send commit to all participants
-		sendToParticipants(resps, "commit")
+		sendToParticipants(resps, &Decision{Commit: true})
 
 		// send commit to master
-		MessagesToMaster.Enqueue("ack commit")
+		fmt.Fprintln(w, "ack", o)
 
-		// add song to local playlist
+		// delete song from local playlist
 		LocalPlaylist.DeleteSong(song)
 	} else {
 		// some participant voted no
 
 		// write abort record in DT log
-		writeToDtLog("abort delete", song)
+		o := outcome{Txn: txn, Reason: ABORT_VOTE_NO, Ids: noVoters}
+		writeDecision(op, o)
 
 		// send abort to all processes that voted yes
 		sendAbortToYesVoters(resps)
 
 		// send abort to master
-		MessagesToMaster.Enqueue("ack abort")
+		fmt.Fprintln(w, "ack", o)
+	}
+}
+
+// stepDown hands coordinatorship over to the server with the given id (or the
+// next live id after this server's if target is -1)
+//
+// New add/delete commands are refused while stepping down (including those
+// already waiting for TxnMutex, see isCoordinator), and the handoff waits for
+// the in-flight transaction (if any) to finish. If the target does not accept
+// the handoff, this server remains the coordinator.
+func stepDown(w io.Writer, target int) {
+	atomic.StoreInt32(&STEPPING_DOWN, 1)
+	defer atomic.StoreInt32(&STEPPING_DOWN, 0)
+
+	// wait for the in-flight transaction to commit or abort
+	TxnMutex.Lock()
+	defer TxnMutex.Unlock()
+
+	if target == -1 {
+		if target = nextLiveId(); target == ID || !Members.Contains(target) {
+			replyError(w, ERR_FAILED, "cannot step down: no other server to hand off to")
+			return
+		}
+	} else if !Members.Contains(target) {
+		replyError(w, ERR_INVALID_ARG, target, " is not a member")
+		return
+	} else if target == ID {
+		replyError(w, ERR_INVALID_ARG, "cannot hand off to ", target, " (this server)")
+		return
+	}
+	if !LastTimestamp.IsAlive(target) {
+		replyError(w, ERR_FAILED, "cannot step down: ", target, " is not alive")
+		return
+	} else if !peerSupports(target, "handoff") {
+		replyError(w, ERR_FAILED, "cannot step down: ", target, " does not support handoffs")
+		return
 	}
 
-	return
+	handoff := &Handoff{Epoch: Coordinator.Epoch() + 1}
+	resp, err := sendAndWaitForResponse(handoff, target)
+	if err != nil {
+		replyError(w, ERR_TIMEOUT, "handoff to ", target, " failed: ", err)
+		return
+	} else if err := expectAck(resp); err != nil {
+		replyError(w, ERR_FAILED, "handoff to ", target, " refused: ", err)
+		return
+	}
+
+	Coordinator.Adopt(target, handoff.Epoch)
+	fmt.Fprintln(w, "ok")
+}
+
+// steppingDown returns true while the coordinator hands off (see stepDown)
+func steppingDown() bool {
+	return atomic.LoadInt32(&STEPPING_DOWN) == 1
+}
+
+// isCoordinator returns true if this server is the coordinator and isn't
+// stepping down, and otherwise writes a "not-coordinator" or "busy" error to w
+//
+// NOTE: commands that run a transaction check again once they hold TxnMutex,
+// since the coordinator may have stepped down while they waited for it.
+func isCoordinator(w io.Writer) bool {
+	if coordinator := Coordinator.Id(); coordinator == -1 {
+		replyError(w, ERR_NOT_COORDINATOR,
+			protocol.NotCoordinator(-1, "the coordinator is unknown"))
+		return false
+	} else if coordinator != ID {
+		replyError(w, ERR_NOT_COORDINATOR, protocol.NotCoordinator(coordinator,
+			"the coordinator is "+strconv.Itoa(coordinator)))
+		return false
+	} else if steppingDown() {
+		replyError(w, ERR_BUSY, "stepping down")
+		return false
+	}
+	return true
 }
 
-func broadcastToParticipantsAndAwaitResponses(msg string) ([]response, error, bool) {
+// nextLiveId returns the lowest live id greater than this server's id, wrapping
+// around to the lowest live id (or ID if no other server is alive)
+func nextLiveId() int {
+	alive := LastTimestamp.GetAlive(time.Now())
+	for _, id := range alive {
+		if id > ID {
+			return id
+		}
+	}
+	if len(alive) == 0 {
+		return ID
+	}
+	return alive[0]
+}
+
+// addServerCoordinator adds the server with the given id to the cluster (see
+// configCoordinator)
+func addServerCoordinator(s *masterSession, arg string) {
+	id, err := strconv.Atoi(arg)
+	if err != nil {
+		replyError(s, ERR_INVALID_ARG, "invalid server id: ", protocol.QuoteField(arg))
+		return
+	} else if Members.Contains(id) {
+		replyError(s, ERR_INVALID_ARG, "server ", id, " is already a member of the cluster")
+		return
+	} else if !LastTimestamp.IsAlive(id) {
+		Error("server ", id, " is not alive")
+		fmt.Fprintln(s, "ack", outcome{Reason: ABORT_NOT_ALIVE, Ids: []int{id}})
+		return
+	}
+
+	configCoordinator(s, append(Members.Ids(), id), []int{id})
+}
+
+// removeServerCoordinator retires the server with the given id from the
+// cluster (see configCoordinator)
+func removeServerCoordinator(s *masterSession, arg string) {
+	id, err := strconv.Atoi(arg)
+	if err != nil {
+		replyError(s, ERR_INVALID_ARG, "invalid server id: ", protocol.QuoteField(arg))
+		return
+	} else if !Members.Contains(id) {
+		replyError(s, ERR_INVALID_ARG, "server ", id, " is not a member of the cluster")
+		return
+	} else if id == ID {
+		replyError(s, ERR_INVALID_ARG, "cannot remove the coordinator (step down first)")
+		return
+	}
+
+	var ids []int
+	for _, member := range Members.Ids() {
+		if member != id {
+			ids = append(ids, member)
+		}
+	}
+	configCoordinator(s, ids, nil)
+}
+
+// configCoordinator commits a new configuration (i.e. the ids of the members of
+// the cluster) via 3PC. Servers that are joining the cluster receive a copy of
+// the coordinator's state before they are asked to vote.
+func configCoordinator(s *masterSession, ids, joining []int) {
+	TxnMutex.Lock()
+	defer TxnMutex.Unlock()
+	if !isCoordinator(s) {
+		return
+	}
+
+	sort.Ints(ids)
+	config := protocol.FormatIds(ids)
+
+	txn := newTxnId()
+	op := Operation{Kind: "config", Config: config}
+
+	// every participant must understand membership changes
+	participants := append(LastTimestamp.GetAlive(time.Now()), joining...)
+	for _, id := range participants {
+		if id != ID && !peerSupports(id, "membership") {
+			Error("server ", id, " does not support membership changes")
+			o := outcome{Txn: txn, Reason: ABORT_UNSUPPORTED, Ids: []int{id}}
+			writeDecision(op, o)
+			fmt.Fprintln(s, "ack", o)
+			return
+		}
+	}
+
+	// send the current state to joining servers
+	for _, id := range joining {
+		if err := transferState(id); err != nil {
+			Error("state transfer to ", id, " failed: ", err)
+			o := outcome{Txn: txn, Reason: ABORT_STATE_TRANSFER, Ids: []int{id}}
+			writeDecision(op, o)
+			fmt.Fprintln(s, "ack", o)
+			return
+		}
+	}
+
+	InFlight.Add(txn, op)
+	defer InFlight.Remove(txn)
+
+	// write start-3pc record in DT log
+	writeToDtLog("start-3pc config", config)
+
+	// send VOTE-REQ to all participants (including joining servers)
+	// AND wait for vote messages from all participants
+	resps, err, timeout := broadcastAndAwaitResponses(participants,
+		&VoteReq{Txn: txn, Op: op})
+	if timeout || err != nil {
+		// write abort record in DT log
+		o := outcome{Txn: txn, Reason: ABORT_TIMEOUT,
+			Ids: silentParticipants(participants, resps)}
+		writeDecision(op, o)
+
+		// send abort to all processes that voted yes
+		sendAbortToYesVoters(resps)
+
+		// send abort to master
+		fmt.Fprintln(s, "ack", o)
+		return
+	}
+
+	if noVoters := noVoters(resps); len(noVoters) == 0 {
+		// send pre-commit to all participants (2PC has no pre-commit
+		// round)
+		if PROTOCOL == "3pc" {
+			sendToParticipantsAndAwaitAcks(resps, &PreCommit{})
+		}
+
+		// write commit record to DT log and switch configurations
+		o := outcome{Txn: txn, Commit: true}
+		writeDecision(op, o)
+		applyConfig(config)
+
+		// send commit to all participants
+		sendToParticipants(resps, &Decision{Commit: true})
+
+		// send commit to master
+		fmt.Fprintln(s, "ack", o)
+	} else {
+		// some participant voted no
+
+		// write abort record in DT log
+		o := outcome{Txn: txn, Reason: ABORT_VOTE_NO, Ids: noVoters}
+		writeDecision(op, o)
+
+		// send abort to all processes that voted yes
+		sendAbortToYesVoters(resps)
+
+		// send abort to master
+		fmt.Fprintln(s, "ack", o)
+	}
+}
+
+// transferState sends the current configuration and playlist to the server
+// with the given id and waits for it to acknowledge them
+func transferState(id int) error {
+	resp, err := sendAndWaitForResponse(&StateTransfer{
+		Members:  Members.Ids(),
+		Playlist: LocalPlaylist.Copy(),
+	}, id)
+	if err != nil {
+		return err
+	}
+	return expectAck(resp)
+}
+
+func broadcastAndAwaitResponses(participants []int, msg *VoteReq) ([]response, error, bool) {
 	type connection struct {
 		c  net.Conn
 		id int
@@ -339,25 +862,20 @@ func broadcastToParticipantsAndAwaitResponses(msg string) ([]response, error, bo
 
 	var responses []response
 	var conns []connection
+	var err error
 	timeout := false
 
-	msgBytes, err := json.Marshal(newMessage(msg))
-	if err != nil {
-		return nil, err, timeout
-	}
-	msgJSON := string(msgBytes)
-
 	// send message to operational participants
-	for _, id := range LastTimestamp.GetAlive(time.Now()) {
+	for _, id := range participants {
 		if id == ID {
 			continue
 		}
 
 		var conn net.Conn
-		conn, err = net.Dial("tcp", ":"+strconv.Itoa(START_PORT+id))
+		conn, err = dialPeer(id)
 		if err == nil {
 			conn.SetWriteDeadline(time.Now().Add(TIMEOUT))
-			_, err = fmt.Fprintln(conn, msgJSON)
+			err = writeMessage(conn, msg)
 			if err == nil {
 				conns = append(conns, connection{conn, id})
 			} else {
@@ -369,11 +887,9 @@ func broadcastToParticipantsAndAwaitResponses(msg string) ([]response, error, bo
 	// wait for responses from all recipients
 	for _, conn := range conns {
 		conn.c.SetDeadline(time.Now().Add(TIMEOUT))
-		r := bufio.NewReader(conn.c)
 
 		var resp string
-		resp, err = r.ReadString('\n')
-		resp = strings.TrimSpace(resp)
+		resp, err = readReply(conn.c)
 		if err == nil {
 			responses = append(responses, response{resp, conn.c, conn.id})
 		} else {
@@ -384,7 +900,7 @@ func broadcastToParticipantsAndAwaitResponses(msg string) ([]response, error, bo
 	return responses, err, timeout
 }
 
-func broadcastToParticipantsAndAwaitResponsesTermination(participants []int, msg string) []response {
+func broadcastToParticipantsAndAwaitResponsesTermination(participants []int, msg *StateReq) []response {
 	type connection struct {
 		c  net.Conn
 		id int
@@ -392,12 +908,7 @@ func broadcastToParticipantsAndAwaitResponsesTermination(participants []int, msg
 
 	var responses []response
 	var conns []connection
-
-	msgBytes, err := json.Marshal(newMessage(msg))
-	if err != nil {
-		return nil
-	}
-	msgJSON := string(msgBytes)
+	var err error
 
 	// send message to participants
 	for _, id := range participants {
@@ -407,10 +918,10 @@ func broadcastToParticipantsAndAwaitResponsesTermination(participants []int, msg
 		}
 
 		var conn net.Conn
-		conn, err = net.Dial("tcp", ":"+strconv.Itoa(START_PORT+id))
+		conn, err = dialPeer(id)
 		if err == nil {
 			conn.SetWriteDeadline(time.Now().Add(TIMEOUT))
-			_, err = fmt.Fprintln(conn, msgJSON)
+			err = writeMessage(conn, msg)
 			if err == nil {
 				conns = append(conns, connection{conn, id})
 			} else {
@@ -422,11 +933,9 @@ func broadcastToParticipantsAndAwaitResponsesTermination(participants []int, msg
 	// wait for responses from all recipients
 	for _, conn := range conns {
 		conn.c.SetDeadline(time.Now().Add(TIMEOUT))
-		r := bufio.NewReader(conn.c)
 
 		var resp string
-		resp, err = r.ReadString('\n')
-		resp = strings.TrimSpace(resp)
+		resp, err = readReply(conn.c)
 		if err == nil {
 			responses = append(responses, response{resp, conn.c, conn.id})
 		}
@@ -436,26 +945,16 @@ func broadcastToParticipantsAndAwaitResponsesTermination(participants []int, msg
 }
 
 func sendAbortToYesVoters(resps []response) {
-	abortBytes, err := json.Marshal(newMessage("abort"))
-	if err != nil {
-		Error("failed to marshal \"abort\" into message")
-		return
-	}
-	abortJson := string(abortBytes)
 	for _, resp := range resps {
 		if resp.v == "yes" {
-			// send abort
-			conn, err := net.Dial("tcp", ":"+strconv.Itoa(START_PORT+resp.id))
-			defer conn.Close()
-			if err == nil {
-				conn.SetWriteDeadline(time.Now().Add(TIMEOUT))
-				fmt.Fprintln(conn, abortJson)
-			}
+			// send abort (on the stream the vote arrived on)
+			resp.c.SetWriteDeadline(time.Now().Add(TIMEOUT))
+			writeMessage(resp.c, &Decision{Commit: false})
 		}
 	}
 }
 
-func sendToParticipantsAndAwaitAcks(participants []response, msg string) {
+func sendToParticipantsAndAwaitAcks(participants []response, msg Payload) {
 	// send message to participants
 	sendToParticipants(participants, msg)
 
@@ -463,26 +962,25 @@ func sendToParticipantsAndAwaitAcks(participants []response, msg string) {
 	for _, ptc := range participants {
 		if ptc.c != nil {
 			ptc.c.SetDeadline(time.Now().Add(TIMEOUT))
-			r := bufio.NewReader(ptc.c)
 
 			// read ack from recipient
-			r.ReadString('\n')
+			readReply(ptc.c)
 		}
 	}
 }
 
-func sendToParticipants(participants []response, msg string) {
+func sendToParticipants(participants []response, msg Payload) {
 	// send message to participants
 	for i, ptc := range participants {
 		ptc.c.SetWriteDeadline(time.Now().Add(TIMEOUT))
-		_, err := fmt.Fprintln(ptc.c, msg)
+		err := writeMessage(ptc.c, msg)
 		if err != nil {
 			participants[i].c = nil
 		}
 	}
 }
 
-func sendToUncertainParticipantsAndAwaitAcks(participants []response, msg string) {
+func sendToUncertainParticipantsAndAwaitAcks(participants []response, msg Payload) {
 	// send message to participants
 	sendToUncertainParticipants(participants, msg)
 
@@ -490,20 +988,19 @@ func sendToUncertainParticipantsAndAwaitAcks(participants []response, msg string
 	for _, ptc := range participants {
 		if ptc.c != nil && ptc.v == "uncertain" {
 			ptc.c.SetDeadline(time.Now().Add(TIMEOUT))
-			r := bufio.NewReader(ptc.c)
 
 			// read ack from recipient
-			r.ReadString('\n')
+			readReply(ptc.c)
 		}
 	}
 }
 
-func sendToUncertainParticipants(participants []response, msg string) {
+func sendToUncertainParticipants(participants []response, msg Payload) {
 	// send message to participants
 	for i, ptc := range participants {
 		if ptc.v == "uncertain" {
 			ptc.c.SetWriteDeadline(time.Now().Add(TIMEOUT))
-			_, err := fmt.Fprintln(ptc.c, msg)
+			err := writeMessage(ptc.c, msg)
 			if err != nil {
 				participants[i].c = nil
 			}
@@ -518,18 +1015,21 @@ func sendToUncertainParticipants(participants []response, msg string) {
 func getParticipant(conn net.Conn, song string) {
 	url := LocalPlaylist.GetSongUrl(song)
 	conn.SetWriteDeadline(time.Now().Add(TIMEOUT))
-	fmt.Fprintln(conn, "resp", url)
+	writeMessage(conn, &GetResp{Url: url})
 }
 
-func addParticipant(ln net.Listener, conn net.Conn, song, url string) {
+func addParticipant(conn net.Conn, txn, song, url string) {
+	InFlight.Add(txn, Operation{Kind: "add", Song: song, Url: url})
+	defer InFlight.Remove(txn)
+
 	vote := vote(url)
 	if vote == "yes" {
 		// write yes record in DT log
-		writeToDtLog("yes add", song, url)
+		writeToDtLog("yes add", song, url, "txn="+txn)
 
 		// vote yes
 		conn.SetWriteDeadline(time.Now().Add(TIMEOUT))
-		fmt.Fprintln(conn, "yes")
+		writeMessage(conn, &Vote{Yes: true})
 
 		// wait for message from coordinator
 		msg, err, timeout := waitForMessageFromCoordinator(conn)
@@ -538,26 +1038,13 @@ func addParticipant(ln net.Listener, conn net.Conn, song, url string) {
 			if elected {
 				// invoke coordinator's algorithm of
 				// termination protocol
-				addTerminationProtocolCoordinator(participants, song, url)
+				addTerminationProtocolCoordinator(participants, txn, song, url)
 			} else {
 				// invoke participant's algorithm of
 				// termination protocol
-
-				// wait for connection from coordinator
-				lnr := (ln).(*net.TCPListener)
-			startYes:
-				lnr.SetDeadline(time.Now().Add(TIMEOUT * time.Duration(NUM_PROCS)))
-				conn, err := lnr.Accept()
-				if netErr := err.(net.Error); netErr.Timeout() {
-					elected, participants := initiateElectionProtocol()
-					if elected {
-						addTerminationProtocolCoordinator(participants, song, url)
-					} else {
-						goto startYes
-					}
-				}
-
-				addTerminationProtocolParticipant(conn, song, url)
+				awaitTermination("add", song, func(participants []int) {
+					addTerminationProtocolCoordinator(participants, txn, song, url)
+				})
 			}
 			return
 		} else if err != nil {
@@ -567,11 +1054,11 @@ func addParticipant(ln net.Listener, conn net.Conn, song, url string) {
 
 		if msg == "pre-commit" {
 			// write pre-commit record in DT log
-			writeToDtLog("pre-commit add", song, url)
+			writeToDtLog("pre-commit add", song, url, "txn="+txn)
 
 			// send ack to coordinator
 			conn.SetWriteDeadline(time.Now().Add(TIMEOUT))
-			fmt.Fprintln(conn, "ack")
+			writeMessage(conn, &Ack{})
 
 			// wait for commit from coordinator
 			msg, err, timeout := waitForMessageFromCoordinator(conn)
@@ -580,27 +1067,13 @@ func addParticipant(ln net.Listener, conn net.Conn, song, url string) {
 				if elected {
 					// invoke coordinator's algorithm of
 					// termination protocol
-					addTerminationProtocolCoordinator(participants, song, url)
+					addTerminationProtocolCoordinator(participants, txn, song, url)
 				} else {
 					// invoke participant's algorithm of
 					// termination protocol
-
-					// wait for connection from coordinator
-					lnr := (ln).(*net.TCPListener)
-					defer lnr.SetDeadline(time.Time{})
-				startPrecommit:
-					lnr.SetDeadline(time.Now().Add(TIMEOUT * time.Duration(NUM_PROCS)))
-					conn, err := lnr.Accept()
-					if netErr := err.(net.Error); netErr.Timeout() {
-						elected, participants := initiateElectionProtocol()
-						if elected {
-							addTerminationProtocolCoordinator(participants, song, url)
-						} else {
-							goto startPrecommit
-						}
-					}
-
-					addTerminationProtocolParticipant(conn, song, url)
+					awaitTermination("add", song, func(participants []int) {
+						addTerminationProtocolCoordinator(participants, txn, song, url)
+					})
 				}
 				return
 			} else if err != nil {
@@ -610,16 +1083,24 @@ func addParticipant(ln net.Listener, conn net.Conn, song, url string) {
 
 			if msg == "commit" {
 				// write commit record in DT log
-				writeToDtLog("commit add", song, url)
+				writeToDtLog("commit add", song, url, "txn="+txn)
 
 				// add song to local playlist
 				LocalPlaylist.AddOrUpdateSong(song, url)
 			} else {
 				Error("coordinator did not respond commit: ", msg)
 			}
+		} else if msg == "commit" {
+			// the coordinator runs 2PC (no pre-commit round)
+
+			// write commit record in DT log
+			writeToDtLog("commit add", song, url, "txn="+txn)
+
+			// add song to local playlist
+			LocalPlaylist.AddOrUpdateSong(song, url)
 		} else if msg == "abort" {
 			// write abort record in DT log
-			writeToDtLog("abort add", song, url)
+			writeToDtLog("abort add", song, url, "txn="+txn)
 		} else {
 			Error("unrecognized response from coordinator: ", msg)
 			return
@@ -627,20 +1108,23 @@ func addParticipant(ln net.Listener, conn net.Conn, song, url string) {
 	} else {
 		// vote no
 		conn.SetWriteDeadline(time.Now().Add(TIMEOUT))
-		fmt.Fprintln(conn, "no")
+		writeMessage(conn, &Vote{Yes: false})
 
 		// write abort record in DT log
-		writeToDtLog("abort add", song, url)
+		writeToDtLog("abort add", song, url, "txn="+txn)
 	}
 }
 
-func deleteParticipant(ln net.Listener, conn net.Conn, song string) {
+func deleteParticipant(conn net.Conn, txn, song string) {
+	InFlight.Add(txn, Operation{Kind: "delete", Song: song})
+	defer InFlight.Remove(txn)
+
 	// write yes record in DT log
-	writeToDtLog("yes delete", song)
+	writeToDtLog("yes delete", song, "txn="+txn)
 
 	// vote yes
 	conn.SetWriteDeadline(time.Now().Add(TIMEOUT))
-	fmt.Fprintln(conn, "yes")
+	writeMessage(conn, &Vote{Yes: true})
 
 	// wait for message from coordinator
 	msg, err, timeout := waitForMessageFromCoordinator(conn)
@@ -649,27 +1133,13 @@ func deleteParticipant(ln net.Listener, conn net.Conn, song string) {
 		if elected {
 			// invoke coordinator's algorithm of
 			// termination protocol
-			deleteTerminationProtocolCoordinator(participants, song)
+			deleteTerminationProtocolCoordinator(participants, txn, song)
 		} else {
 			// invoke participant's algorithm of
 			// termination protocol
-
-			// wait for connection from coordinator
-			lnr := (ln).(*net.TCPListener)
-			defer lnr.SetDeadline(time.Time{})
-		startYes:
-			lnr.SetDeadline(time.Now().Add(TIMEOUT * time.Duration(NUM_PROCS)))
-			conn, err := lnr.Accept()
-			if netErr := err.(net.Error); netErr.Timeout() {
-				elected, participants := initiateElectionProtocol()
-				if elected {
-					deleteTerminationProtocolCoordinator(participants, song)
-				} else {
-					goto startYes
-				}
-			}
-
-			deleteTerminationProtocolParticipant(conn, song)
+			awaitTermination("delete", song, func(participants []int) {
+				deleteTerminationProtocolCoordinator(participants, txn, song)
+			})
 		}
 		return
 	} else if err != nil {
@@ -679,11 +1149,11 @@ func deleteParticipant(ln net.Listener, conn net.Conn, song string) {
 
 	if msg == "pre-commit" {
 		// write pre-commit record in DT log
-		writeToDtLog("pre-commit delete", song)
+		writeToDtLog("pre-commit delete", song, "txn="+txn)
 
 		// send ack to coordinator
 		conn.SetWriteDeadline(time.Now().Add(TIMEOUT))
-		fmt.Fprintln(conn, "ack")
+		writeMessage(conn, &Ack{})
 
 		// wait for commit from coordinator
 		msg, _, timeout := waitForMessageFromCoordinator(conn)
@@ -692,50 +1162,140 @@ func deleteParticipant(ln net.Listener, conn net.Conn, song string) {
 			if elected {
 				// invoke coordinator's algorithm of
 				// termination protocol
-				deleteTerminationProtocolCoordinator(participants, song)
+				deleteTerminationProtocolCoordinator(participants, txn, song)
 			} else {
 				// invoke participant's algorithm of
 				// termination protocol
-
-				// wait for connection from coordinator
-				lnr := (ln).(*net.TCPListener)
-				defer lnr.SetDeadline(time.Time{})
-			startPrecommit:
-				lnr.SetDeadline(time.Now().Add(TIMEOUT * time.Duration(NUM_PROCS)))
-				conn, err := lnr.Accept()
-				if netErr := err.(net.Error); netErr.Timeout() {
-					elected, participants := initiateElectionProtocol()
-					if elected {
-						deleteTerminationProtocolCoordinator(participants, song)
-					} else {
-						goto startPrecommit
-					}
-				}
-
-				deleteTerminationProtocolParticipant(conn, song)
+				awaitTermination("delete", song, func(participants []int) {
+					deleteTerminationProtocolCoordinator(participants, txn, song)
+				})
 			}
 			return
 		}
 
 		if msg == "commit" {
 			// write commit record in DT log
-			writeToDtLog("commit delete", song)
+			writeToDtLog("commit delete", song, "txn="+txn)
 
 			// delete song from local playlist
 			LocalPlaylist.DeleteSong(song)
 		} else {
 			Error("coordinator did not respond commit: ", msg)
 		}
+	} else if msg == "commit" {
+		// the coordinator runs 2PC (no pre-commit round)
+
+		// write commit record in DT log
+		writeToDtLog("commit delete", song, "txn="+txn)
+
+		// delete song from local playlist
+		LocalPlaylist.DeleteSong(song)
 	} else if msg == "abort" {
 		// write abort record in DT log
-		writeToDtLog("abort delete", song)
+		writeToDtLog("abort delete", song, "txn="+txn)
 	} else {
 		Error("unrecognized response from coordinator: ", msg)
 		return
 	}
 }
 
+func configParticipant(conn net.Conn, txn, config string) {
+	InFlight.Add(txn, Operation{Kind: "config", Config: config})
+	defer InFlight.Remove(txn)
+
+	// write yes record in DT log
+	writeToDtLog("yes config", config, "txn="+txn)
+
+	// vote yes
+	conn.SetWriteDeadline(time.Now().Add(TIMEOUT))
+	writeMessage(conn, &Vote{Yes: true})
+
+	// wait for message from coordinator
+	msg, err, timeout := waitForMessageFromCoordinator(conn)
+	if !timeout && err == nil && msg == "pre-commit" {
+		// write pre-commit record in DT log
+		writeToDtLog("pre-commit config", config, "txn="+txn)
+
+		// send ack to coordinator
+		conn.SetWriteDeadline(time.Now().Add(TIMEOUT))
+		writeMessage(conn, &Ack{})
+
+		// wait for commit from coordinator
+		msg, err, timeout = waitForMessageFromCoordinator(conn)
+		if !timeout && err == nil && msg != "commit" {
+			Error("coordinator did not respond commit: ", msg)
+			return
+		}
+	}
+
+	if timeout {
+		elected, participants := initiateElectionProtocol()
+		if elected {
+			// invoke coordinator's algorithm of
+			// termination protocol
+			configTerminationProtocolCoordinator(participants, txn, config)
+			return
+		}
+
+		// invoke participant's algorithm of termination
+		// protocol
+		awaitTermination("config", config, func(participants []int) {
+			configTerminationProtocolCoordinator(participants, txn, config)
+		})
+		return
+	} else if err != nil {
+		Error(err)
+		return
+	}
+
+	switch msg {
+	case "commit":
+		// write commit record in DT log and switch configurations
+		commitConfig(config)
+	case "abort":
+		// write abort record in DT log
+		writeToDtLog("abort config", config, "txn="+txn)
+	default:
+		Error("unrecognized response from coordinator: ", msg)
+	}
+}
+
+// acceptStateTransfer replaces this server's configuration and playlist with
+// the ones sent by the coordinator before this server joins the cluster
+func acceptStateTransfer(conn net.Conn, state *StateTransfer) {
+	Members.Set(state.Members)
+	LocalPlaylist.Replace(state.Playlist)
+
+	conn.SetWriteDeadline(time.Now().Add(TIMEOUT))
+	writeMessage(conn, &Ack{})
+}
+
+// acceptHandoff makes this server the coordinator of the epoch carried by the
+// handoff message msg (see stepDown)
+func acceptHandoff(conn net.Conn, msg *Handoff) {
+	if !Coordinator.Adopt(ID, msg.Epoch) {
+		conn.SetWriteDeadline(time.Now().Add(TIMEOUT))
+		writeMessage(conn, &Refusal{Reason: fmt.Sprint("stale epoch ", Coordinator.Epoch())})
+		return
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(TIMEOUT))
+	writeMessage(conn, &Ack{})
+
+	// tell the master that this server is the coordinator
+	Masters.Notify("coordinator " + strconv.Itoa(ID))
+}
+
+// vote returns this server's vote ("yes" or "no") on adding a song with the
+// given url (see VOTE_POLICY)
 func vote(url string) string {
+	switch VOTE_POLICY {
+	case "yes":
+		return "yes"
+	case "no":
+		return "no"
+	}
+
 	if len(url) > ID+5 {
 		return "no"
 	} else {
@@ -744,11 +1304,10 @@ func vote(url string) string {
 }
 
 func waitForMessageFromCoordinator(conn net.Conn) (string, error, bool) {
-	r := bufio.NewReader(conn)
 	// increase the TIMEOUT because a msg must be sent to each other
 	// participant
 	conn.SetDeadline(time.Now().Add(TIMEOUT * time.Duration(NUM_PROCS)))
-	response, err := r.ReadString('\n')
+	response, err := readReply(conn)
 	if err != nil {
 		netErr, ok := err.(net.Error)
 		if ok && netErr.Timeout() {
@@ -760,210 +1319,215 @@ func waitForMessageFromCoordinator(conn net.Conn) (string, error, bool) {
 		}
 	}
 
-	return strings.TrimSpace(response), nil, false
+	return response, nil, false
+}
+
+// awaitTermination waits for the new coordinator to terminate the transaction
+// on the given song (or configuration) after the coordinator of the
+// transaction failed, i.e. for a decision to be written to the DT log (the new
+// coordinator's STATE-REQ is handled concurrently, see receive). If the new
+// coordinator fails too, and this server is elected, terminate runs the
+// coordinator's algorithm of the termination protocol instead.
+func awaitTermination(kind, key string, terminate func(participants []int)) {
+	for {
+		time.Sleep(TIMEOUT * time.Duration(NUM_PROCS))
+		if _, decision := readVoteOrDecisionFromLog(kind, key); decision == "commit" || decision == "abort" {
+			return
+		}
+
+		if Coordinator.Id() == ID {
+			// this server was elected in the meantime
+			terminate(LastTimestamp.GetAlive(time.Now()))
+			return
+		} else if LastTimestamp.IsAlive(Coordinator.Id()) {
+			continue
+		}
+
+		elected, participants := initiateElectionProtocol()
+		if elected {
+			terminate(participants)
+			return
+		}
+	}
 }
 
+// initiateElectionProtocol makes the next live server after the failed
+// coordinator the coordinator of a new epoch, and returns true along with the
+// other live servers if that is this server
+//
+// NOTE: if the coordinator changed in the meantime (e.g. another server was
+// elected and this server heard about it), nobody is elected.
 func initiateElectionProtocol() (elected bool, participants []int) {
+	coordinator, epoch := Coordinator.Get()
 	alive := LastTimestamp.GetAlive(time.Now())
-	for ; len(alive) > 0 && COORDINATOR >= alive[0]; alive = alive[1:] {
+	for ; len(alive) > 0 && coordinator >= alive[0]; alive = alive[1:] {
 	}
+	next := ID
 	if len(alive) > 0 {
-		COORDINATOR = alive[0]
+		next = alive[0]
 		participants = alive[1:]
-	} else {
-		COORDINATOR = ID
+	}
+	if !Coordinator.CompareAndSet(epoch, next, epoch+1) {
+		return false, nil
 	}
 
-	if COORDINATOR == ID {
+	if next == ID {
 		// tell the master that this server is the coordinator
-		MessagesToMaster.Enqueue("coordinator " + strconv.Itoa(ID))
+		Masters.Notify("coordinator " + strconv.Itoa(ID))
 		elected = true
 	}
 
 	return elected, participants
 }
 
-func addTerminationProtocolCoordinator(participants []int, song, url string) {
+// newTxnId returns a new transaction id of the form <epoch>.<id>.<nanoseconds>
+func newTxnId() string {
+	return fmt.Sprintf("%d.%d.%d", Coordinator.Epoch(), ID, time.Now().UnixNano())
+}
+
+// txnEpoch returns the epoch in which the given transaction was started (or -1
+// if the id is malformed)
+func txnEpoch(txn string) int {
+	epoch, err := strconv.Atoi(strings.SplitN(txn, ".", 2)[0])
+	if err != nil {
+		return -1
+	}
+	return epoch
+}
+
+// terminateTransaction invokes the coordinator's algorithm of the termination
+// protocol for the given operation
+func terminateTransaction(participants []int, txn string, operation Operation) {
+	switch operation.Kind {
+	case "add":
+		addTerminationProtocolCoordinator(participants, txn, operation.Song, operation.Url)
+	case "delete":
+		deleteTerminationProtocolCoordinator(participants, txn, operation.Song)
+	case "config":
+		configTerminationProtocolCoordinator(participants, txn, operation.Config)
+	default:
+		Error("cannot terminate transaction ", txn,
+			": unrecognized operation \"", operation, "\"")
+	}
+}
+
+func addTerminationProtocolCoordinator(participants []int, txn, song, url string) {
 	// send STATE-REQ to all participants
 	// AND wait for state report messages
+	op := Operation{Kind: "add", Song: song, Url: url}
 	resps := broadcastToParticipantsAndAwaitResponsesTermination(
-		participants, fmt.Sprintf("state-req add %s %s", song, url))
-	terminationProtocolCoordinatorBody(resps, song, "add "+song+" "+url)
+		participants, &StateReq{Txn: txn, Op: op})
+	terminationProtocolCoordinatorBody(resps, txn, op)
 }
 
-func deleteTerminationProtocolCoordinator(participants []int, song string) {
+func deleteTerminationProtocolCoordinator(participants []int, txn, song string) {
 	// send STATE-REQ to all participants
 	// AND wait for state report messages
+	op := Operation{Kind: "delete", Song: song}
 	resps := broadcastToParticipantsAndAwaitResponsesTermination(
-		participants, fmt.Sprintf("state-req delete %s", song))
-	terminationProtocolCoordinatorBody(resps, song, "delete "+song)
+		participants, &StateReq{Txn: txn, Op: op})
+	terminationProtocolCoordinatorBody(resps, txn, op)
 }
 
-func addTerminationProtocolParticipant(conn net.Conn, song, url string) {
-	c := bufio.NewReader(conn)
-start:
-	// wait for state-req from coordinator
-	conn.SetDeadline(time.Now().Add(TIMEOUT * time.Duration(NUM_PROCS)))
-	_, err := c.ReadString('\n')
-	if netErr := err.(net.Error); netErr.Timeout() {
-		elected, participants := initiateElectionProtocol()
-		if elected {
-			addTerminationProtocolCoordinator(participants, song, url)
-		} else {
-			goto start
-		}
-	}
-
-	var state string
-	_, decision := readVoteOrDecisionFromLog(song)
-	if decision == "" || decision == "abort" {
-		state = "abort"
-	} else if decision == "commit" {
-		state = "commit"
-	} else if decision == "pre-commit" {
-		state = "pre-commit"
-	} else {
-		state = "uncertain"
-	}
-
-	// send state to coordinator
-	conn.SetWriteDeadline(time.Now().Add(TIMEOUT))
-	fmt.Fprintln(conn, state)
+func configTerminationProtocolCoordinator(participants []int, txn, config string) {
+	// send STATE-REQ to all participants
+	// AND wait for state report messages
+	op := Operation{Kind: "config", Config: config}
+	resps := broadcastToParticipantsAndAwaitResponsesTermination(
+		participants, &StateReq{Txn: txn, Op: op})
+	terminationProtocolCoordinatorBody(resps, txn, op)
 
-	// wait for response from coordinator
-	conn.SetDeadline(time.Now().Add(TIMEOUT * time.Duration(NUM_PROCS)))
-	resp, err := c.ReadString('\n')
-	if netErr := err.(net.Error); netErr.Timeout() {
-		elected, participants := initiateElectionProtocol()
-		if elected {
-			addTerminationProtocolCoordinator(participants, song, url)
-		} else {
-			goto start
-		}
+	if _, decision := readVoteOrDecisionFromLog("config", config); decision == "commit" {
+		applyConfig(config)
 	}
+}
 
-	switch resp {
-	case "abort":
-		if decision == "" {
-			writeToDtLog("abort add", song, url)
-		}
-	case "commit":
-		if decision == "" {
-			writeToDtLog("commit add", song, url)
-		}
-	default:
-		// response was pre-commit
-
-		// send ack to coordinator
-		conn.SetWriteDeadline(time.Now().Add(TIMEOUT))
-		fmt.Fprintln(conn, "ack")
-
-		// wait for commit from coordinator
+// terminationProtocolParticipant runs the participant's side of the
+// termination protocol of transaction txn, which performs the given operation
+func terminationProtocolParticipant(conn net.Conn, txn string, op Operation) {
+	// readFromCoordinator returns the next reply sent by the coordinator
+	// (or false if the coordinator timed out, in which case the
+	// termination protocol was restarted)
+	readFromCoordinator := func() (string, bool) {
 		conn.SetDeadline(time.Now().Add(TIMEOUT * time.Duration(NUM_PROCS)))
-		resp, err := c.ReadString('\n')
-		if netErr := err.(net.Error); netErr.Timeout() {
+		resp, err := readReply(conn)
+		if err == errBlocked {
+			// wait for a server that knows the decision (see
+			// terminationProtocolCoordinatorBody)
+			return "", false
+		} else if err != nil {
 			elected, participants := initiateElectionProtocol()
 			if elected {
-				addTerminationProtocolCoordinator(participants, song, url)
-			} else {
-				goto start
+				terminateTransaction(participants, txn, op)
 			}
+			return "", false
 		}
-		if resp != "commit" {
-			Error("coordinator responded with \"", resp, "\" instead of 'commit'")
-		}
-
-		writeToDtLog("commit add", song, url)
+		return resp, true
 	}
-}
 
-func deleteTerminationProtocolParticipant(conn net.Conn, song string) {
-	c := bufio.NewReader(conn)
-start:
-	// wait for state-req from coordinator
-	conn.SetDeadline(time.Now().Add(TIMEOUT * time.Duration(NUM_PROCS)))
-	_, err := c.ReadString('\n')
-	if netErr := err.(net.Error); netErr.Timeout() {
-		elected, participants := initiateElectionProtocol()
-		if elected {
-			deleteTerminationProtocolCoordinator(participants, song)
-		} else {
-			goto start
+	// commit writes the commit record (and switches configurations)
+	commit := func() {
+		writeDecision(op, outcome{Txn: txn, Commit: true})
+		if op.Kind == "config" {
+			applyConfig(op.Config)
 		}
 	}
 
-	var state string
-	_, decision := readVoteOrDecisionFromLog(song)
-	if decision == "" || decision == "abort" {
-		state = "abort"
-	} else if decision == "commit" {
-		state = "commit"
-	} else if decision == "pre-commit" {
-		state = "pre-commit"
-	} else {
+	vote, decision := readVoteOrDecisionFromLog(op.Kind, op.key())
+	state := decision
+	if decision == "" && vote == "yes" {
 		state = "uncertain"
+	} else if decision == "" {
+		state = "abort"
 	}
 
 	// send state to coordinator
 	conn.SetWriteDeadline(time.Now().Add(TIMEOUT))
-	fmt.Fprintln(conn, state)
+	writeMessage(conn, &StateReport{State: state})
 
 	// wait for response from coordinator
-	conn.SetDeadline(time.Now().Add(TIMEOUT * time.Duration(NUM_PROCS)))
-	resp, err := c.ReadString('\n')
-	if netErr := err.(net.Error); netErr.Timeout() {
-		elected, participants := initiateElectionProtocol()
-		if elected {
-			deleteTerminationProtocolCoordinator(participants, song)
-		} else {
-			goto start
-		}
+	resp, ok := readFromCoordinator()
+	if !ok {
+		return
 	}
 
 	switch resp {
 	case "abort":
 		if decision == "" {
-			writeToDtLog("abort delete", song)
+			writeDecision(op, outcome{Txn: txn, Reason: ABORT_TERMINATION})
 		}
 	case "commit":
 		if decision == "" {
-			writeToDtLog("commit delete", song)
+			commit()
 		}
 	default:
 		// response was pre-commit
 
 		// send ack to coordinator
 		conn.SetWriteDeadline(time.Now().Add(TIMEOUT))
-		fmt.Fprintln(conn, "ack")
+		writeMessage(conn, &Ack{})
 
 		// wait for commit from coordinator
-		conn.SetDeadline(time.Now().Add(TIMEOUT * time.Duration(NUM_PROCS)))
-		resp, err := c.ReadString('\n')
-		if netErr := err.(net.Error); netErr.Timeout() {
-			elected, participants := initiateElectionProtocol()
-			if elected {
-				deleteTerminationProtocolCoordinator(participants, song)
-			} else {
-				goto start
-			}
-		}
-		if resp != "commit" {
+		resp, ok := readFromCoordinator()
+		if !ok {
+			return
+		} else if resp != "commit" {
 			Error("coordinator responded with \"", resp, "\" instead of 'commit'")
 		}
 
-		writeToDtLog("commit delete", song)
+		commit()
 	}
 }
 
-func terminationProtocolCoordinatorBody(resps []response, song, operation string) {
+func terminationProtocolCoordinatorBody(resps []response, txn string, operation Operation) {
 	// check for decisions from participants
-	anyAborted := false
+	var aborted []int
 	anyCommitted := false
 	allUncertain := true
 	for _, resp := range resps {
 		switch resp.v {
 		case "abort":
-			anyAborted = true
+			aborted = append(aborted, resp.id)
 			allUncertain = false
 			break
 		case "commit":
@@ -977,28 +1541,35 @@ func terminationProtocolCoordinatorBody(resps []response, song, operation string
 		}
 	}
 
-	vote, decision := readVoteOrDecisionFromLog(song)
-	if coordAborted := decision == "abort"; anyAborted || coordAborted {
+	vote, decision := readVoteOrDecisionFromLog(operation.Kind, operation.key())
+	if coordAborted := decision == "abort"; len(aborted) > 0 || coordAborted {
 		// case TR1
 		if !coordAborted {
-			writeToDtLog("abort", operation)
+			writeDecision(operation, outcome{Txn: txn, Reason: ABORT_TERMINATION, Ids: aborted})
 		}
-		sendToParticipants(resps, "abort")
+		sendToParticipants(resps, &Decision{Commit: false})
 	} else if coordCommitted := decision == "commit"; anyCommitted || coordCommitted {
 		// case TR2
 		if !coordCommitted {
-			writeToDtLog("commit", operation)
+			writeDecision(operation, outcome{Txn: txn, Commit: true})
 		}
-		sendToParticipants(resps, "commit")
+		sendToParticipants(resps, &Decision{Commit: true})
+	} else if PROTOCOL == "2pc" {
+		// without a pre-commit round, the failed coordinator may have
+		// committed (or aborted) while every operational server is
+		// uncertain, so the transaction is blocked until a server that
+		// knows the decision recovers (see gossip)
+		Error("transaction ", txn, " is blocked: no operational server knows its outcome")
+		sendToParticipants(resps, &Refusal{Reason: errBlocked.Error()})
 	} else if iAmUncertain := vote == "yes"; allUncertain && iAmUncertain {
 		// case TR3
-		writeToDtLog("abort", operation)
-		sendToParticipants(resps, "abort")
+		writeDecision(operation, outcome{Txn: txn, Reason: ABORT_TERMINATION})
+		sendToParticipants(resps, &Decision{Commit: false})
 	} else {
 		// some processes are Commitable - case TR4
-		sendToUncertainParticipantsAndAwaitAcks(resps, "pre-commit")
-		writeToDtLog("commit", operation)
-		sendToUncertainParticipants(resps, "commit")
+		sendToUncertainParticipantsAndAwaitAcks(resps, &PreCommit{})
+		writeDecision(operation, outcome{Txn: txn, Commit: true})
+		sendToUncertainParticipants(resps, &Decision{Commit: true})
 	}
 }
 
@@ -1021,8 +1592,12 @@ func crashPartialCommit(args []string)    {}
 // DT log     								     //
 ///////////////////////////////////////////////////////////////////////////////
 
-// append a given line to the log
-func writeToDtLog(entry ...interface{}) {
+// append a given record (e.g. "commit add") and its arguments to the log
+//
+// NOTE: arguments containing whitespace (e.g. song names) are quoted, see
+// protocol.SplitFields. Decisions are also sent to the master processes (see
+// master.go).
+func writeToDtLog(record string, args ...interface{}) {
 	file, err := os.OpenFile(DT_LOG, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
 	defer file.Close()
 	if err != nil {
@@ -1030,35 +1605,154 @@ func writeToDtLog(entry ...interface{}) {
 		return
 	}
 
-	fmt.Fprintln(file, entry...)
+	entry := []string{record}
+	for _, arg := range args {
+		entry = append(entry, protocol.QuoteField(fmt.Sprint(arg)))
+	}
+	fmt.Fprintln(file, strings.Join(entry, " "))
+
+	if strings.HasPrefix(record, "commit ") || strings.HasPrefix(record, "abort ") {
+		Masters.Notify("decision " + strings.Join(entry, " "))
+	}
+}
+
+// write a commit record for the given configuration to the log and switch to
+// it
+func commitConfig(config string) {
+	writeToDtLog("commit config", config)
+	applyConfig(config)
+}
+
+// switch to the given configuration (a comma-separated list of ids)
+//
+// NOTE: a server that is no longer a member of the cluster keeps running, but
+// it no longer takes part in transactions
+func applyConfig(config string) {
+	ids, err := protocol.ParseIds(config)
+	if err != nil {
+		Error("invalid configuration: \"", config, "\"")
+		return
+	}
+	Members.Set(ids)
+}
+
+// returns the most recently committed configuration in the log (and false if
+// there is none)
+func readConfigFromLog() ([]int, bool) {
+	log, err := ioutil.ReadFile(DT_LOG)
+	if err != nil {
+		return nil, false
+	}
+
+	lines := bytes.Split(log, []byte{'\n'})
+	for i := len(lines) - 1; i >= 0; i-- {
+		args, _ := protocol.SplitFields(string(lines[i]))
+		if len(args) >= 3 && args[0] == "commit" && args[1] == "config" {
+			ids, err := protocol.ParseIds(args[2])
+			if err == nil {
+				return ids, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// readTxnFromLog returns the fields of the most recent DT log record of the
+// transaction with the given id (e.g. "abort", "add", "song", "url",
+// "txn=<txn>", "reason=vote-no", "ids=2"), see writeDecision
+//
+// NOTE: the records of configuration changes written by the termination
+// protocol don't carry the id of the transaction
+func readTxnFromLog(txn string) ([]string, bool) {
+	log, err := ioutil.ReadFile(DT_LOG)
+	if err != nil {
+		return nil, false
+	}
+
+	field := "txn=" + txn
+	lines := bytes.Split(log, []byte{'\n'})
+	for i := len(lines) - 1; i >= 0; i-- {
+		args, _ := protocol.SplitFields(string(lines[i]))
+		for _, arg := range args {
+			if arg == field {
+				return args, true
+			}
+		}
+	}
+
+	return nil, false
 }
 
-// returns the most recent vote or decision corresponding to the given song
+// parseRecord returns the operation of the DT log record of a transaction
+// (e.g. "commit add song url txn=<txn>", see readTxnFromLog) and the details
+// that follow its arguments (see writeDecision)
+func parseRecord(record []string) (Operation, []string) {
+	op := Operation{Kind: record[1]}
+	details := record[3:]
+	switch op.Kind {
+	case "add":
+		if len(record) > 3 {
+			op.Song, op.Url = record[2], record[3]
+			details = record[4:]
+		}
+	case "delete":
+		op.Song = record[2]
+	case "config":
+		op.Config = record[2]
+	}
+	return op, details
+}
+
+// readRequestFromLog returns the id of the transaction of the client request
+// with the given id (and false if the request is unknown), see replayRequest
+func readRequestFromLog(req string) (string, bool) {
+	log, err := ioutil.ReadFile(DT_LOG)
+	if err != nil {
+		return "", false
+	}
+
+	lines := bytes.Split(log, []byte{'\n'})
+	for i := len(lines) - 1; i >= 0; i-- {
+		args, _ := protocol.SplitFields(string(lines[i]))
+		if len(args) >= 3 && args[0] == "request" && args[1] == req {
+			return args[2], true
+		}
+	}
+
+	return "", false
+}
+
+// returns the most recent vote or decision corresponding to the given kind of
+// operation (e.g. "add") on the given song (or configuration, see
+// Operation.key)
 //
 // the following values are possible:
 //  vote:	"" (no vote found), "yes"
 //  decision:	"" (no decision found), "commit", "abort", "pre-commit"
-func readVoteOrDecisionFromLog(song string) (vote, decision string) {
+//
+// NOTE: the kind is matched too, so that e.g. the records of a song named
+// like a configuration (or of a delete after an add of the same song) are
+// not mistaken for one another.
+func readVoteOrDecisionFromLog(kind, key string) (vote, decision string) {
 	log, err := ioutil.ReadFile(DT_LOG)
 	if err != nil {
 		return
 	}
 
 	lines := bytes.Split(log, []byte{'\n'})
-	songBytes := []byte(song)
 	if len(lines) == 0 {
 		return
 	}
 	for i := len(lines) - 1; i >= 0; i-- {
-		// check to see if the song is the same as in the operation
-		// then set vote or decision accordingly
-		args := bytes.Split(lines[i], []byte{' '})
+		// check to see if the operation and song are the same as in
+		// the record then set vote or decision accordingly
+		args, _ := protocol.SplitFields(string(lines[i]))
 		if len(args) < 3 {
 			continue
 		}
-		logSong := args[2]
-		if bytes.Equal(logSong, songBytes) {
-			switch string(args[0]) {
+		if args[1] == kind && args[2] == key {
+			switch args[0] {
 			case "start-3pc":
 				// I was the coordinator, I neither voted nor
 				// made a decision
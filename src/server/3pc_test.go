@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestStepDownWhileWaitingForTxnMutex checks that a command that waited for
+// TxnMutex while the coordinator stepped down doesn't run its transaction
+func TestStepDownWhileWaitingForTxnMutex(t *testing.T) {
+	defer func(id int) { ID = id }(ID)
+	defer func(id, epoch int) {
+		Coordinator.CompareAndSet(Coordinator.Epoch(), id, epoch)
+	}(Coordinator.Get())
+
+	tests := []struct {
+		name     string
+		stepDown func()
+		reply    string
+	}{
+		{"handed off", func() { Coordinator.Adopt(1, Coordinator.Epoch()+1) },
+			"err " + ERR_NOT_COORDINATOR + " 1 "},
+		{"stepping down", func() { atomic.StoreInt32(&STEPPING_DOWN, 1) },
+			"err " + ERR_BUSY + " stepping down"},
+	}
+
+	ID = 0
+	for _, test := range tests {
+		Coordinator.CompareAndSet(Coordinator.Epoch(), ID, Coordinator.Epoch()+1)
+		atomic.StoreInt32(&STEPPING_DOWN, 0)
+
+		commands := []func(w *bytes.Buffer){
+			func(w *bytes.Buffer) { addCoordinator(w, []string{"song", "http://x"}, "") },
+			func(w *bytes.Buffer) { deleteCoordinator(w, []string{"song"}, "") },
+		}
+		for i, command := range commands {
+			var reply bytes.Buffer
+			done := make(chan bool)
+
+			TxnMutex.Lock()
+			go func() {
+				command(&reply)
+				close(done)
+			}()
+			// give the command time to block on TxnMutex
+			time.Sleep(10 * time.Millisecond)
+			test.stepDown()
+			TxnMutex.Unlock()
+
+			<-done
+			if !strings.HasPrefix(reply.String(), test.reply) {
+				t.Errorf("%s: command %d replied %q, want %q...", test.name, i, reply.String(), test.reply)
+			}
+		}
+	}
+	atomic.StoreInt32(&STEPPING_DOWN, 0)
+}
+
+func TestTerminationProtocolParticipantConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "3pc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(log string) { DT_LOG = log }(DT_LOG)
+	defer Members.Set(Members.Ids())
+
+	tests := []struct {
+		commit  bool
+		record  string
+		members []int
+	}{
+		{false, "abort config 0,1 txn=1.1.1 reason=" + ABORT_TERMINATION, []int{0, 1, 2}},
+		{true, "commit config 0,1 txn=1.1.1", []int{0, 1}},
+	}
+
+	for _, test := range tests {
+		DT_LOG = filepath.Join(dir, "dt.log")
+		os.Remove(DT_LOG)
+		writeToDtLog("yes config", "0,1", "txn=1.1.1")
+		Members.Set([]int{0, 1, 2})
+
+		coordinator, participant := net.Pipe()
+		done := make(chan bool)
+		go func() {
+			terminationProtocolParticipant(participant, "1.1.1",
+				Operation{Kind: "config", Config: "0,1"})
+			close(done)
+		}()
+
+		if state, err := readReply(coordinator); err != nil || state != "uncertain" {
+			t.Fatalf("participant reported %q, %v, want \"uncertain\"", state, err)
+		}
+		writeMessage(coordinator, &Decision{Commit: test.commit})
+		<-done
+		coordinator.Close()
+
+		log, _ := ioutil.ReadFile(DT_LOG)
+		lines := strings.Split(strings.TrimSpace(string(log)), "\n")
+		if record := lines[len(lines)-1]; record != test.record {
+			t.Errorf("commit %v: last record is %q, want %q", test.commit, record, test.record)
+		}
+		if members := Members.Ids(); !reflect.DeepEqual(members, test.members) {
+			t.Errorf("commit %v: members = %v, want %v", test.commit, members, test.members)
+		}
+	}
+}
+
+func TestStepDownInvalidTarget(t *testing.T) {
+	defer func(id int) { ID = id }(ID)
+	defer Members.Set(Members.Ids())
+	ID = 0
+	Members.Set([]int{0, 1})
+
+	tests := []struct {
+		target int
+		reply  string
+	}{
+		{5, "err " + ERR_INVALID_ARG + " 5 is not a member\n"},
+		{-2, "err " + ERR_INVALID_ARG + " -2 is not a member\n"},
+		{0, "err " + ERR_INVALID_ARG + " cannot hand off to 0 (this server)\n"},
+	}
+
+	for _, test := range tests {
+		var reply bytes.Buffer
+		if stepDown(&reply, test.target); reply.String() != test.reply {
+			t.Errorf("stepDown(%d) replied %q, want %q", test.target, reply.String(), test.reply)
+		}
+	}
+}
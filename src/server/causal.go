@@ -0,0 +1,195 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Chat messages (i.e. non-empty Messages, see broadcast) are delivered in causal
+// order: a message is only delivered once every message that its sender had
+// delivered before sending it has been delivered, so a reply never shows up
+// before the message it replies to. This is the causal broadcast of Birman,
+// Schiper and Stephenson, applied by the sequencer before it puts messages in
+// their total order (see order.go).
+//
+// Every message carries a vector clock (see vclock), which counts the messages
+// from each server that its sender had delivered when it sent the message
+// (including its own). A message m from server i is held back until every
+// message that i had delivered from the other servers has been delivered, i.e.
+// until clock[k] >= m.Clock[k] for every k != i. The earlier messages from i
+// itself arrive before m (see receive), so they have been delivered already or
+// were lost (e.g. because their first sequencer failed), and a message that
+// was delivered already (i.e. clock[i] >= m.Clock[i]) is a duplicate.
+//
+// A message that waits for longer than ALIVE_INTERVAL is delivered anyway, in
+// case the messages it waits for were lost as well.
+//
+// NOTE: each server counts its own messages from the time at which it started
+// (like nextSeq), so that its counter keeps increasing when it restarts.
+
+// vclock is a vector clock, keyed by server id (so that it need not change when
+// servers join or leave the cluster)
+type vclock map[int]uint64
+
+func (vc vclock) copy() vclock {
+	c := make(vclock, len(vc))
+	for id, n := range vc {
+		c[id] = n
+	}
+	return c
+}
+
+// merge sets every entry of vc to the maximum of itself and the corresponding
+// entry of other
+func (vc vclock) merge(other vclock) {
+	for id, n := range other {
+		if n > vc[id] {
+			vc[id] = n
+		}
+	}
+}
+
+// before returns true if vc happened before other, i.e. if no entry of vc is
+// greater than the corresponding entry of other (and they differ)
+func (vc vclock) before(other vclock) bool {
+	for id, n := range vc {
+		if n > other[id] {
+			return false
+		}
+	}
+	for id, n := range other {
+		if n > vc[id] {
+			return true
+		}
+	}
+	return false
+}
+
+// heldMessage is a message waiting to be delivered
+type heldMessage struct {
+	msg      *Message
+	deadline time.Time // when the message is delivered anyway
+}
+
+// tsCausalQueue holds back messages until they can be delivered in causal
+// order
+type tsCausalQueue struct {
+	clock vclock        // number of messages delivered from each server
+	sent  uint64        // number of messages stamped by this server
+	held  []heldMessage // messages waiting to be delivered
+	mutex sync.Mutex    // mutex for accessing contents
+}
+
+// Stamp sets the origin and vector clock of a message that this server is about
+// to broadcast
+func (tcq *tsCausalQueue) Stamp(msg *Message) {
+	tcq.mutex.Lock()
+	defer tcq.mutex.Unlock()
+
+	if tcq.sent == 0 {
+		tcq.sent = uint64(time.Now().UnixNano())
+	}
+	tcq.sent++
+	msg.Origin = ID
+	msg.Clock = tcq.clock.copy()
+	msg.Clock[ID] = tcq.sent
+}
+
+// Delivered records that msg was delivered (e.g. in the total order of another
+// sequencer), so that the messages which depend on it are not held back
+func (tcq *tsCausalQueue) Delivered(msg *Message) {
+	tcq.mutex.Lock()
+	defer tcq.mutex.Unlock()
+
+	if tcq.clock == nil {
+		tcq.clock = make(vclock)
+	}
+	tcq.clock.merge(msg.Clock)
+}
+
+// Add holds back msg until the messages it depends on have been delivered, and
+// returns the messages (including msg) that can be delivered now, in causal
+// order
+func (tcq *tsCausalQueue) Add(msg *Message) []*Message {
+	tcq.mutex.Lock()
+	defer tcq.mutex.Unlock()
+
+	if tcq.clock == nil {
+		tcq.clock = make(vclock)
+	}
+	now := time.Now()
+	tcq.held = append(tcq.held, heldMessage{msg, now.Add(ALIVE_INTERVAL)})
+	return tcq.deliver(now)
+}
+
+// Expire returns the messages that can be delivered at the given time because
+// they (or the messages they depend on) were held back for too long
+func (tcq *tsCausalQueue) Expire(now time.Time) []*Message {
+	tcq.mutex.Lock()
+	defer tcq.mutex.Unlock()
+	return tcq.deliver(now)
+}
+
+// deliver removes held messages from the queue until none of them can be
+// delivered, and returns them in the order in which they were removed
+// (dropping duplicates)
+//
+// NOTE: tcq.mutex must be held
+func (tcq *tsCausalQueue) deliver(now time.Time) []*Message {
+	var delivered []*Message
+	for {
+		i := tcq.next(now)
+		if i < 0 {
+			return delivered
+		}
+
+		msg := tcq.held[i].msg
+		tcq.held = append(tcq.held[:i], tcq.held[i+1:]...)
+		if msg.Clock[msg.Origin] <= tcq.clock[msg.Origin] {
+			continue
+		}
+		tcq.clock.merge(msg.Clock)
+		delivered = append(delivered, msg)
+	}
+}
+
+// deliverable returns true if msg can be delivered (see above)
+//
+// NOTE: tcq.mutex must be held
+func (tcq *tsCausalQueue) deliverable(msg *Message) bool {
+	for id, n := range msg.Clock {
+		if id != msg.Origin && n > tcq.clock[id] {
+			return false
+		}
+	}
+	return true
+}
+
+// next returns the index of the held message to deliver next (or -1 if none of
+// them can be delivered yet), i.e. a message that can be delivered or, failing
+// that, the causally first of the messages that have expired
+//
+// NOTE: tcq.mutex must be held
+func (tcq *tsCausalQueue) next(now time.Time) int {
+	var expired []int
+	for i, h := range tcq.held {
+		if tcq.deliverable(h.msg) {
+			return i
+		} else if !now.Before(h.deadline) {
+			expired = append(expired, i)
+		}
+	}
+	for _, i := range expired {
+		first := true
+		for _, j := range expired {
+			if tcq.held[j].msg.Clock.before(tcq.held[i].msg.Clock) {
+				first = false
+				break
+			}
+		}
+		if first {
+			return i
+		}
+	}
+	return -1
+}
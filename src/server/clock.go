@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Servers estimate how far the clocks of other servers are off from their own
+// using heartbeats, in the style of Cristian's algorithm. Every heartbeat
+// echoes the send time and the (local) arrival time of the last heartbeat
+// received from each server (see Message.Echo). When server A receives the echo
+// of one of its heartbeats from server B, it knows
+//
+//  t1  when A sent its heartbeat (by A's clock)
+//  t2  when B received it (by B's clock)
+//  t3  when B sent the echo (by B's clock)
+//  t4  when A received the echo (by A's clock)
+//
+// so the heartbeat and its echo spent (t4 - t1) - (t3 - t2) in transit, and B's
+// clock is ahead of A's by ((t2 - t1) + (t3 - t4)) / 2, give or take half of
+// that round trip. The sample with the shortest round trip among the last few
+// is the most accurate estimate.
+//
+// NOTE: clock offsets are only displayed (see the "clock" command) and alerted
+// on (see MAX_CLOCK_SKEW). Failures are detected by local arrival times alone,
+// so servers with skewed clocks are not mistaken for dead ones (or vice versa).
+
+const (
+	// Number of samples of each server's clock offset that are remembered
+	CLOCK_WINDOW = 8
+)
+
+// echo is the send time (by the sender's clock) and the arrival time (by the
+// receiver's clock) of a heartbeat
+type echo struct {
+	Sent     time.Time `json:"t1"`
+	Received time.Time `json:"t2"`
+}
+
+// clockSample is a single estimate of the offset of another server's clock
+type clockSample struct {
+	offset    time.Duration // how far the other clock is ahead of this server's
+	roundTrip time.Duration // time spent in transit (the error is at most half)
+}
+
+// clockEstimator estimates the offset of another server's clock from the last
+// CLOCK_WINDOW samples
+type clockEstimator struct {
+	samples []clockSample
+	next    int  // index of the oldest sample once the window is full
+	skewed  bool // true once an alert was raised for the current skew
+}
+
+// add computes a sample from the echo e of a heartbeat of this server, which
+// came back with a heartbeat sent at the given time (by the other server's
+// clock) that arrived now
+func (c *clockEstimator) add(e *echo, sent time.Time, now time.Time) {
+	now = now.Round(0) // compare wall clock times only
+	s := clockSample{
+		offset:    (e.Received.Sub(e.Sent) + sent.Sub(now)) / 2,
+		roundTrip: now.Sub(e.Sent) - sent.Sub(e.Received),
+	}
+	if s.roundTrip < 0 {
+		return
+	}
+
+	if len(c.samples) < CLOCK_WINDOW {
+		c.samples = append(c.samples, s)
+	} else {
+		c.samples[c.next] = s
+		c.next = (c.next + 1) % CLOCK_WINDOW
+	}
+}
+
+// estimate returns the sample with the shortest round trip (and false if there
+// are no samples)
+func (c *clockEstimator) estimate() (clockSample, bool) {
+	if len(c.samples) == 0 {
+		return clockSample{}, false
+	}
+
+	best := c.samples[0]
+	for _, s := range c.samples[1:] {
+		if s.roundTrip < best.roundTrip {
+			best = s
+		}
+	}
+	return best, true
+}
+
+// checkSkew logs an error (once) when the estimated offset of the clock of the
+// server with the given id exceeds MAX_CLOCK_SKEW
+func (c *clockEstimator) checkSkew(id int) {
+	best, ok := c.estimate()
+	if !ok || MAX_CLOCK_SKEW == 0 {
+		return
+	}
+
+	skewed := best.offset > MAX_CLOCK_SKEW || best.offset < -MAX_CLOCK_SKEW
+	if skewed && !c.skewed {
+		Metrics.Add("clock_skew_alerts", 1)
+		Error("clock of server ", id, " is off by ", formatOffset(best.offset),
+			" (more than ", MAX_CLOCK_SKEW, ")")
+	}
+	c.skewed = skewed
+}
+
+// formatOffset returns d in milliseconds with a sign (e.g. "+1.250ms")
+func formatOffset(d time.Duration) string {
+	return fmt.Sprintf("%+.3fms", millis(d))
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"time"
+)
+
+// clusterConfig is the contents of a cluster configuration file, e.g.
+//
+//  {
+//    "members": [
+//      {"id": 0, "peer": "127.0.0.2:20000", "master": "127.0.0.2:30000",
+//       "http": "127.0.0.2:8080"},
+//      {"id": 1, "peer": "127.0.0.3:20000", "master": "127.0.0.3:30000"},
+//      {"id": 2, "peer": "127.0.0.4:20000", "master": "127.0.0.4:30000"}
+//    ],
+//    "initial": [0, 1],
+//    "heartbeat_interval": "200ms",
+//    "alive_interval": "600ms",
+//    "phi_threshold": 8,
+//    "timeout": "10ms"
+//  }
+//
+// "members" lists every server that may take part in the cluster. "initial"
+// lists the ids of the servers in the initial configuration (all members by
+// default), whose number replaces the -n flag; the rest can be added with
+// "addServer". A member's "master" address replaces the -port flag (which is
+// only required for members that have none). Any timeout (or threshold) that
+// is left out (or provided via a flag) keeps its default (or flag) value.
+type clusterConfig struct {
+	Members           []memberConfig `json:"members"`
+	Initial           []int          `json:"initial"`
+	HeartbeatInterval duration       `json:"heartbeat_interval"`
+	AliveInterval     duration       `json:"alive_interval"`
+	PhiThreshold      *float64       `json:"phi_threshold"`
+	Timeout           duration       `json:"timeout"`
+}
+
+// memberConfig is the entry for a single server in a cluster configuration file
+type memberConfig struct {
+	Id     int    `json:"id"`
+	Peer   string `json:"peer"`   // address of the server-facing port
+	Master string `json:"master"` // address of the master-facing port
+	Http   string `json:"http"`   // address of the HTTP API (optional, see http.go)
+}
+
+// duration is a time.Duration that is read from a JSON string such as "200ms"
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	} else if v <= 0 {
+		return errors.New("non-positive duration: " + s)
+	}
+	*d = duration(v)
+	return nil
+}
+
+// loadConfig reads the cluster configuration file at the given path and sets
+// the addresses, initial configuration and timeouts accordingly
+func loadConfig(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var config clusterConfig
+	if err := json.Unmarshal(b, &config); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	var ids []int
+	for _, m := range config.Members {
+		if _, ok := PEER_ADDRS[m.Id]; ok {
+			return fmt.Errorf("%s: duplicate id %d", path, m.Id)
+		} else if m.Peer == "" {
+			return fmt.Errorf("%s: no peer address for id %d", path, m.Id)
+		}
+		PEER_ADDRS[m.Id] = m.Peer
+		if m.Id == ID && m.Master != "" {
+			MASTER_ADDR = m.Master
+		}
+		if m.Id == ID && m.Http != "" && !isFlagSet("http") {
+			HTTP_ADDR = m.Http
+		}
+		ids = append(ids, m.Id)
+	}
+	if _, ok := PEER_ADDRS[ID]; !ok {
+		return fmt.Errorf("%s: no entry for id %d", path, ID)
+	}
+
+	if config.Initial != nil {
+		ids = config.Initial
+	}
+	for _, id := range ids {
+		if _, ok := PEER_ADDRS[id]; !ok {
+			return fmt.Errorf("%s: no entry for initial member %d", path, id)
+		}
+	}
+	INITIAL_MEMBERS = ids
+	NUM_PROCS = len(ids)
+
+	// timeouts provided via flags take precedence
+	if config.HeartbeatInterval != 0 && !isFlagSet("heartbeat") {
+		HEARTBEAT_INTERVAL = time.Duration(config.HeartbeatInterval)
+	}
+	if config.AliveInterval != 0 && !isFlagSet("alive") {
+		ALIVE_INTERVAL = time.Duration(config.AliveInterval)
+	}
+	if config.PhiThreshold != nil && !isFlagSet("phi") {
+		PHI_THRESHOLD = *config.PhiThreshold
+	}
+	if config.Timeout != 0 && !isFlagSet("timeout") {
+		TIMEOUT = time.Duration(config.Timeout)
+	}
+
+	return nil
+}
+
+// peerAddr returns the address of the server-facing port of the server with the
+// given id, i.e. the one from the cluster configuration file or
+// ":<START_PORT + id>" if there is none
+func peerAddr(id int) string {
+	if addr, ok := PEER_ADDRS[id]; ok {
+		return addr
+	}
+	return ":" + strconv.Itoa(START_PORT+id)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Servers are suspected to have failed by a phi accrual failure detector
+// (Hayashibara et al., "The φ Accrual Failure Detector"). Rather than calling a
+// server dead as soon as its last heartbeat is older than a fixed interval, it
+// learns the distribution of the intervals between the heartbeats of each
+// server and computes phi, the level of suspicion that the server failed given
+// how long ago its last heartbeat arrived:
+//
+//  phi = -log10(probability that the next heartbeat arrives even later)
+//
+// i.e. phi = 1 means that suspecting the server is wrong 10% of the time, phi =
+// 2 means 1%, phi = 3 means 0.1% and so on. A server is considered dead once
+// its phi reaches PHI_THRESHOLD, so servers whose heartbeats arrive irregularly
+// (e.g. because they run on a loaded machine) are given more time, and servers
+// whose heartbeats arrive like clockwork less.
+//
+// With the default settings and punctual heartbeats, a server is considered
+// dead about 3.6 heartbeat intervals after its last heartbeat arrived.
+//
+// Heartbeats are numbered (see nextBeat), so that a heartbeat that arrives
+// after a later one (they are read concurrently, see receive) is ignored.
+
+const (
+	// Number of intervals between heartbeats of a server that the failure
+	// detector remembers
+	PHI_WINDOW = 100
+)
+
+var Beat uint64 // sequence number of the last heartbeat sent (see nextBeat)
+
+// nextBeat returns the sequence number of the next heartbeat sent by this
+// server
+//
+// NOTE: like the sequence numbers of envelopes (see nextSeq), heartbeats are
+// numbered from the time at which the server started, so they keep increasing
+// when it restarts.
+func nextBeat() uint64 {
+	atomic.CompareAndSwapUint64(&Beat, 0, uint64(time.Now().UnixNano()))
+	return atomic.AddUint64(&Beat, 1)
+}
+
+// heartbeatHistory is the arrival time of the last heartbeat of a server along
+// with the intervals between its previous heartbeats
+type heartbeatHistory struct {
+	last      time.Time // local arrival time of the last heartbeat
+	beat      uint64    // sequence number of the last heartbeat
+	intervals []float64 // last PHI_WINDOW intervals (in milliseconds)
+	oldest    int       // index of the oldest interval once the window is full
+	sum       float64   // sum of intervals
+	sumSq     float64   // sum of squares of intervals
+}
+
+// record adds the interval between the last heartbeat and a heartbeat with the
+// given sequence number that arrived at the given time to the history, and
+// returns false if the heartbeat is older than the last one (and was ignored)
+//
+// NOTE: heartbeats from servers that don't number them have sequence number 0
+func (h *heartbeatHistory) record(beat uint64, now time.Time) bool {
+	if beat != 0 && beat <= h.beat {
+		return false
+	}
+	h.beat = beat
+
+	if !h.last.IsZero() {
+		h.add(millis(now.Sub(h.last)))
+	}
+	h.last = now
+	return true
+}
+
+func (h *heartbeatHistory) add(interval float64) {
+	if len(h.intervals) == PHI_WINDOW {
+		old := h.intervals[h.oldest]
+		h.sum -= old
+		h.sumSq -= old * old
+		h.intervals[h.oldest] = interval
+		h.oldest = (h.oldest + 1) % PHI_WINDOW
+	} else {
+		h.intervals = append(h.intervals, interval)
+	}
+	h.sum += interval
+	h.sumSq += interval * interval
+}
+
+// stats returns the mean and standard deviation of the intervals between
+// heartbeats
+//
+// Until the first interval is known, the mean is assumed to be the heartbeat
+// interval. The standard deviation is at least half the heartbeat interval, so
+// that a late heartbeat or two after a long series of punctual ones doesn't
+// cause a server to be suspected.
+func (h *heartbeatHistory) stats() (float64, float64) {
+	mean := millis(HEARTBEAT_INTERVAL)
+	variance := 0.0
+	if n := float64(len(h.intervals)); n > 0 {
+		mean = h.sum / n
+		variance = h.sumSq/n - mean*mean
+	}
+	return mean, math.Max(math.Sqrt(math.Max(variance, 0)),
+		millis(HEARTBEAT_INTERVAL)/2)
+}
+
+// phi returns the level of suspicion that the server failed at the given time
+// (+Inf if no heartbeat arrived since it was last marked dead)
+func (h *heartbeatHistory) phi(now time.Time) float64 {
+	if h.last.IsZero() {
+		return math.Inf(1)
+	}
+
+	// the normal distribution's tail is approximated with a logistic
+	// function, which is accurate to within 0.01% (and much cheaper)
+	mean, stddev := h.stats()
+	elapsed := millis(now.Sub(h.last))
+	y := (elapsed - mean) / stddev
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if elapsed > mean {
+		return -math.Log10(e / (1 + e))
+	}
+	return -math.Log10(1 - 1/(1+e))
+}
+
+// formatPhi returns phi rounded to two decimals (or "inf")
+func formatPhi(phi float64) string {
+	if math.IsInf(phi, 1) {
+		return "inf"
+	}
+	return strconv.FormatFloat(phi, 'f', 2, 64)
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"protocol"
+)
+
+// A master can send "add" and "delete" commands to any server, not just the
+// coordinator. A server that is not the coordinator forwards the command to
+// the coordinator (see forward), which runs the transaction on its behalf and
+// sends back its reply (e.g. "ack commit"), which is relayed to the master.
+//
+// If the coordinator is unknown, stepping down, or fails before it replies,
+// the command is forwarded again once a new coordinator has been chosen (for at
+// most NUM_PROCS attempts).
+//
+// Commands that don't carry a request id are given one before they are first
+// forwarded, so that a command whose coordinator fails after it committed the
+// transaction but before it replied is answered with the outcome of that
+// transaction by the new coordinator, rather than carried out again (which
+// could e.g. delete a song that was added again in the meantime, see
+// replayRequest).
+//
+// NOTE: commands are not forwarded to coordinators that don't support the
+// "forward" feature (the master is told to send them to the coordinator
+// instead).
+
+// forward executes the add or delete command args as the coordinator, or
+// forwards it to the coordinator, and writes the reply to w
+func forward(w io.Writer, args []string) {
+	n := 3 // number of arguments of "add <song> <url>"
+	if args[0] == "delete" {
+		n = 2
+	}
+	if _, ok := requestId(args, n); !ok {
+		args = append(args[:n:n], "req="+newRequestId())
+	}
+
+	for attempt := 0; attempt < NUM_PROCS; attempt++ {
+		if attempt > 0 {
+			// give the servers time to elect a new coordinator
+			time.Sleep(ALIVE_INTERVAL)
+		}
+
+		coordinator := Coordinator.Id()
+		switch {
+		case coordinator == ID && !steppingDown():
+			executeTransaction(w, args)
+			return
+		case coordinator == -1 || coordinator == ID || !LastTimestamp.IsAlive(coordinator):
+			continue
+		case !peerSupports(coordinator, "forward"):
+			replyError(w, ERR_NOT_COORDINATOR, protocol.NotCoordinator(coordinator,
+				"the coordinator is "+strconv.Itoa(coordinator)+
+					" (which does not support forwarding)"))
+			return
+		}
+
+		reply, err := forwardTo(coordinator, args)
+		if err != nil {
+			Error("failed to forward ", args[0], " to ", coordinator, ": ", err)
+			continue
+		} else if attempt > 0 && strings.HasPrefix(reply, "err "+ERR_BUSY+" ") {
+			// the transaction started by an earlier attempt hasn't
+			// been terminated yet
+			continue
+		}
+		fmt.Fprintln(w, reply)
+		return
+	}
+
+	replyError(w, ERR_TIMEOUT, "no coordinator to forward ", args[0], " to")
+}
+
+// newRequestId returns a new request id of the form <id>.<nanoseconds> for a
+// command that doesn't carry one (see forward)
+func newRequestId() string {
+	return fmt.Sprintf("%d.%d", ID, time.Now().UnixNano())
+}
+
+// forwardTo sends the command args to the server with the given id and returns
+// its reply
+//
+// NOTE: the reply is awaited for as long as the server is alive, since the
+// transaction may have to wait for the one in flight (see TxnMutex)
+func forwardTo(id int, args []string) (string, error) {
+	conn, err := dialPeer(id)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(TIMEOUT))
+	if err := writeMessage(conn, &Forward{Args: args}); err != nil {
+		return "", err
+	}
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(ALIVE_INTERVAL))
+		_, resp, err := readMessage(conn)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			if LastTimestamp.IsAlive(id) {
+				continue
+			}
+			return "", errors.New("timeout")
+		} else if err != nil {
+			return "", err
+		}
+
+		switch resp := resp.(type) {
+		case *ForwardResp:
+			return resp.Reply, nil
+		case *Refusal:
+			return "", errors.New(resp.Reason)
+		default:
+			return "", fmt.Errorf("unexpected %s message", resp.Type())
+		}
+	}
+}
+
+// acceptForward executes the command forwarded by another server (see
+// forward) as the coordinator, and sends back the reply
+//
+// NOTE: like other requests that belong to transactions, forwards are handled
+// by the goroutine that read them (see receive), so a transaction that waits
+// for the one in flight (see TxnMutex) doesn't delay the sender's heartbeats
+// or other requests.
+func acceptForward(conn net.Conn, msg *Forward) {
+	if Coordinator.Id() != ID || steppingDown() {
+		conn.SetWriteDeadline(time.Now().Add(TIMEOUT))
+		writeMessage(conn, &Refusal{Reason: "not the coordinator"})
+		return
+	}
+
+	var reply bytes.Buffer
+	executeTransaction(&reply, msg.Args)
+
+	conn.SetWriteDeadline(time.Now().Add(TIMEOUT))
+	writeMessage(conn, &ForwardResp{Reply: strings.TrimSpace(reply.String())})
+}
+
+// executeTransaction runs the add or delete command args as the coordinator
+// and writes the reply to w
+func executeTransaction(w io.Writer, args []string) {
+	switch {
+	case len(args) >= 3 && args[0] == "add":
+		req, _ := requestId(args, 3)
+		addCoordinator(w, args[1:], req)
+	case len(args) >= 2 && args[0] == "delete":
+		req, _ := requestId(args, 2)
+		deleteCoordinator(w, args[1:], req)
+	default:
+		replyError(w, ERR_MALFORMED, "malformed forwarded command")
+	}
+}
@@ -1,17 +1,15 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"os"
-	"runtime/debug"
 	"strconv"
 )
 
 // Error logs the given error
 func Error(err ...interface{}) {
-	// TODO: REMOVE
-	debug.PrintStack()
 	log.Println(ERROR + " " + fmt.Sprint(err...))
 }
 
@@ -20,33 +18,137 @@ func Fatal(err ...interface{}) {
 	log.Fatalln(ERROR + " " + fmt.Sprint(err...))
 }
 
-// setArgsPositional parses the first three command line arguments into ID,
-// NUM_PROCS, and PORT respectively. It should be called if no arguments were
-// provided via flags.
+// setArgsFlags defines the command line flags and parses them into the
+// corresponding global variables. Flags must come before any positional
+// arguments (see setArgsPositional).
+func setArgsFlags() {
+	flag.IntVar(&ID, "id", -1, "id of the server")
+	flag.IntVar(&NUM_PROCS, "n", -1,
+		"number of servers in the initial configuration")
+	flag.IntVar(&MASTER_PORT, "port", -1, "master-facing port")
+	flag.IntVar(&START_PORT, "peer-port", START_PORT,
+		"`base` port of the server-facing ports (which are base + id)")
+	flag.StringVar(&CONFIG_FILE, "config", "",
+		"cluster configuration `file` (see clusterConfig)")
+	flag.StringVar(&LOG_DIR, "logdir", LOG_DIR, "`directory` for DT logs")
+	flag.DurationVar(&HEARTBEAT_INTERVAL, "heartbeat", HEARTBEAT_INTERVAL,
+		"interval between heartbeats")
+	flag.Float64Var(&PHI_THRESHOLD, "phi", PHI_THRESHOLD,
+		"level of suspicion at which a server is considered dead "+
+			"(0 to use the alive interval instead)")
+	flag.DurationVar(&ALIVE_INTERVAL, "alive", 0,
+		"interval after its last heartbeat for which a server is alive "+
+			"if -phi is 0 (default 3 * heartbeat)")
+	flag.DurationVar(&TIMEOUT, "timeout", TIMEOUT,
+		"timeout for waiting for a response from another server")
+	flag.DurationVar(&MAX_CLOCK_SKEW, "max-skew", MAX_CLOCK_SKEW,
+		"offset between clocks of servers beyond which an error is "+
+			"logged (0 for no limit)")
+	flag.StringVar(&VOTE_POLICY, "vote", VOTE_POLICY,
+		"vote `policy`: \"length\" (vote no on urls longer than id + 5 "+
+			"characters), \"yes\" or \"no\"")
+	flag.StringVar(&PROTOCOL, "mode", PROTOCOL,
+		"protocol `mode`: \"3pc\" or \"2pc\" (no pre-commit round)")
+	flag.StringVar(&TLS_DIR, "tls", "",
+		"`directory` of certificates for mutual TLS between servers "+
+			"(see gencerts)")
+	flag.StringVar(&KEY_FILE, "keyfile", "",
+		"`file` of keys for signing messages between servers (see hmac.go)")
+	flag.StringVar(&HTTP_ADDR, "http", "",
+		"`address` of the HTTP API, e.g. \":8080\" (disabled if empty, "+
+			"see http.go)")
+	flag.Usage = usage
+	flag.Parse()
+}
+
+// setArgsPositional parses the first three positional command line arguments
+// into ID, NUM_PROCS, and PORT respectively (unless they were provided via
+// flags) and the optional fourth into CONFIG_FILE. With -config, only the id is
+// required, since the cluster configuration file provides the rest.
 func setArgsPositional() {
+	args := flag.Args()
 	getIntArg := func(i int) int {
-		if len(os.Args) < 4 {
+		if len(args) <= i {
 			fmt.Fprintf(os.Stderr, "%v: missing one or more "+
-				"arguments (there are %d)\n"+
-				"(e.g. \"%v 0 1 10000\" OR \"%v -id 0 -n 1 "+
-				"-port 10000)\"\n\n",
-				os.Args, len(REQUIRED_ARGUMENTS),
-				os.Args[0], os.Args[0])
-			os.Exit(1)
+				"arguments (there are %d)\n",
+				os.Args, len(REQUIRED_ARGUMENTS))
+			usage()
+			os.Exit(2)
 		}
 
-		arg := os.Args[i+1]
+		arg := args[i]
 		val, err := strconv.Atoi(arg)
 		if err != nil {
 			fmt.Fprintf(os.Stderr,
 				"could not parse: '%v' into an integer\n", arg)
+			usage()
+			os.Exit(2)
 		}
 		return val
 	}
 
 	for idx, val := range REQUIRED_ARGUMENTS {
-		if *val == -1 {
-			*val = getIntArg(idx)
+		if *val != -1 || (CONFIG_FILE != "" && idx > 0 && len(args) <= idx) {
+			continue
 		}
+		*val = getIntArg(idx)
+	}
+
+	if len(args) > len(REQUIRED_ARGUMENTS) && CONFIG_FILE == "" {
+		CONFIG_FILE = args[len(REQUIRED_ARGUMENTS)]
 	}
 }
+
+// isFlagSet returns true if the flag with the given name was provided on the
+// command line
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// validateArgs exits if any of the command line arguments (or the settings
+// from the cluster configuration file) is invalid
+func validateArgs() {
+	switch {
+	case ID < 0:
+		Fatal("invalid id: ", ID)
+	case CONFIG_FILE == "" && NUM_PROCS <= 0:
+		Fatal("invalid number of servers: ", NUM_PROCS)
+	case CONFIG_FILE == "" && (MASTER_PORT <= 0 || MASTER_PORT > 65535):
+		Fatal("invalid master-facing port: ", MASTER_PORT)
+	case MASTER_ADDR == "":
+		Fatal("no master-facing address for id ", ID, " (see -port)")
+	case START_PORT <= 0 || START_PORT+ID > 65535:
+		Fatal("invalid peer base port: ", START_PORT)
+	case HEARTBEAT_INTERVAL <= 0:
+		Fatal("invalid heartbeat interval: ", HEARTBEAT_INTERVAL)
+	case PHI_THRESHOLD < 0:
+		Fatal("invalid suspicion threshold: ", PHI_THRESHOLD)
+	case ALIVE_INTERVAL < HEARTBEAT_INTERVAL:
+		Fatal("alive interval (", ALIVE_INTERVAL, ") is shorter than ",
+			"the heartbeat interval (", HEARTBEAT_INTERVAL, ")")
+	case TIMEOUT <= 0:
+		Fatal("invalid timeout: ", TIMEOUT)
+	case MAX_CLOCK_SKEW < 0:
+		Fatal("invalid maximum clock skew: ", MAX_CLOCK_SKEW)
+	case VOTE_POLICY != "length" && VOTE_POLICY != "yes" && VOTE_POLICY != "no":
+		Fatal("invalid vote policy: \"", VOTE_POLICY, "\"")
+	case PROTOCOL != "3pc" && PROTOCOL != "2pc":
+		Fatal("invalid protocol mode: \"", PROTOCOL, "\"")
+	}
+}
+
+// usage prints the usage message for the server's command line arguments
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %v [flags] [id] [n] [port] [config]\n"+
+		"(e.g. \"%v 0 1 10000\" OR \"%v -id 0 -n 1 -port 10000\" OR "+
+		"\"%v -id 0 -config cluster.json\")\n\n",
+		os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+	flag.PrintDefaults()
+}
+
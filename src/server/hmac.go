@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// As a lighter alternative to TLS, servers can sign every envelope with an
+// HMAC (see the -keyfile flag). The HMAC covers the ids of the sender and the
+// receiver, the timestamp, the message itself and a sequence number, so that
+// messages cannot be forged, or replayed (to the same or another server), by
+// anyone who doesn't know the cluster's secret.
+//
+// The key file holds one key per line (blank lines and lines starting with '#'
+// are ignored). Envelopes are signed with the first key, and accepted if they
+// are signed with any of them. To rotate keys without downtime:
+//
+//  1. append the new key to the key file of every server and restart them
+//  2. move the new key to the top of every key file and restart the servers
+//  3. remove the old key from every key file and restart the servers
+//
+// Every server numbers the envelopes it sends to each other server separately
+// (see nextSeq), so that a receiver sees consecutive sequence numbers from each
+// sender however many servers there are, and only rejects a legitimate
+// envelope if it arrives after REPLAY_WINDOW later ones.
+//
+// NOTE: sequence numbers start from the time at which the sender started, so
+// they keep increasing when the sender restarts. A server that restarts forgets
+// which sequence numbers it has seen, though, so envelopes are also rejected if
+// their timestamp is more than MAX_ENVELOPE_AGE away from the receiver's clock,
+// which bounds what can be replayed to it.
+
+const (
+	// Minimum length of a key (in bytes)
+	MIN_KEY_LENGTH = 16
+
+	// Number of sequence numbers below the highest one received from a
+	// server that are accepted (once each), since messages sent over
+	// different streams may arrive out of order
+	REPLAY_WINDOW = 64
+
+	// Maximum difference between the timestamp of an envelope and the time
+	// at which it is received (which must allow for the offset between the
+	// clocks of the servers, see MAX_CLOCK_SKEW)
+	MAX_ENVELOPE_AGE = 30 * time.Second
+)
+
+var (
+	CLUSTER_KEYS [][]byte // HMAC keys (nil unless KEY_FILE is set, see loadKeys)
+
+	Sequences tsSequences // sequence numbers of the last envelopes sent to each server
+	Replays   tsReplayMap // sequence numbers received from each server
+)
+
+// loadKeys reads the HMAC keys from the key file at the given path
+func loadKeys(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var keys [][]byte
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		} else if len(line) < MIN_KEY_LENGTH {
+			return fmt.Errorf("%s: keys must be at least %d bytes long",
+				path, MIN_KEY_LENGTH)
+		}
+		keys = append(keys, []byte(line))
+	}
+	if len(keys) == 0 {
+		return errors.New(path + ": no keys found")
+	}
+	CLUSTER_KEYS = keys
+
+	// count dropped messages even if there are none
+	for _, reason := range []string{"unsigned", "forged", "misdirected", "stale", "replayed"} {
+		Metrics.Add("dropped_"+reason, 0)
+	}
+	return nil
+}
+
+// nextSeq returns the sequence number of the next envelope sent by this server
+// to the server with the given id
+func nextSeq(to int) uint64 {
+	return Sequences.Next(to)
+}
+
+// computeMac returns the HMAC of env (excluding env.Mac) under the given key
+func computeMac(key []byte, env *Envelope) []byte {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%d %s %d %d %d %d ",
+		env.Version, env.Type, env.Id, env.To, env.Rts.UnixNano(), env.Seq)
+	mac.Write(env.Body)
+	return mac.Sum(nil)
+}
+
+// sign sets env.Mac (if HMAC keys are configured)
+func sign(env *Envelope) {
+	if CLUSTER_KEYS != nil {
+		env.Mac = base64.StdEncoding.EncodeToString(computeMac(CLUSTER_KEYS[0], env))
+	}
+}
+
+// authenticate returns an error if HMAC keys are configured and env is
+// unsigned, forged, meant for another server or replayed, and counts the
+// dropped envelope in Metrics
+func authenticate(env *Envelope) error {
+	if CLUSTER_KEYS == nil {
+		return nil
+	}
+
+	drop := func(reason string) error {
+		Metrics.Add("dropped_"+reason, 1)
+		err := fmt.Errorf("dropped %s envelope (type %s) from server %d",
+			reason, env.Type, env.Id)
+		Error(err)
+		return err
+	}
+
+	mac, err := base64.StdEncoding.DecodeString(env.Mac)
+	if env.Mac == "" || err != nil {
+		return drop("unsigned")
+	}
+
+	valid := false
+	for _, key := range CLUSTER_KEYS {
+		if hmac.Equal(mac, computeMac(key, env)) {
+			valid = true
+			break
+		}
+	}
+	if age := time.Since(env.Rts); !valid {
+		return drop("forged")
+	} else if env.To != ID {
+		return drop("misdirected")
+	} else if age > MAX_ENVELOPE_AGE || age < -MAX_ENVELOPE_AGE {
+		return drop("stale")
+	} else if !Replays.Accept(env.Id, env.Seq) {
+		return drop("replayed")
+	}
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// replay protection                                                         //
+///////////////////////////////////////////////////////////////////////////////
+
+// tsSequences holds the sequence number of the last envelope sent to each
+// server
+type tsSequences struct {
+	value map[int]uint64 // keyed by server id
+	mutex sync.Mutex     // mutex for accessing contents
+}
+
+// Next returns the next sequence number for the server with the given id,
+// starting from the current time (see nextSeq)
+func (tss *tsSequences) Next(id int) uint64 {
+	tss.mutex.Lock()
+	defer tss.mutex.Unlock()
+
+	if tss.value == nil {
+		tss.value = make(map[int]uint64)
+	}
+	seq, ok := tss.value[id]
+	if !ok {
+		seq = uint64(time.Now().UnixNano())
+	}
+	seq++
+	tss.value[id] = seq
+	return seq
+}
+
+// replayWindow holds the highest sequence number received from a server and
+// which of the REPLAY_WINDOW sequence numbers below it have been received
+type replayWindow struct {
+	highest uint64
+	seen    uint64 // bit i is set if highest - i was received
+}
+
+type tsReplayMap struct {
+	value map[int]*replayWindow // keyed by server id
+	mutex sync.Mutex            // mutex for accessing contents
+}
+
+// Accept returns true (and records seq) unless the given sequence number was
+// already received from the server with the given id, or is too old to tell
+func (tsm *tsReplayMap) Accept(id int, seq uint64) bool {
+	tsm.mutex.Lock()
+	defer tsm.mutex.Unlock()
+
+	if tsm.value == nil {
+		tsm.value = make(map[int]*replayWindow)
+	}
+	w, ok := tsm.value[id]
+	if !ok {
+		tsm.value[id] = &replayWindow{highest: seq, seen: 1}
+		return true
+	}
+
+	switch {
+	case seq > w.highest:
+		if shift := seq - w.highest; shift >= REPLAY_WINDOW {
+			w.seen = 0
+		} else {
+			w.seen <<= shift
+		}
+		w.seen |= 1
+		w.highest = seq
+		return true
+	case w.highest-seq >= REPLAY_WINDOW:
+		return false
+	default:
+		bit := uint64(1) << (w.highest - seq)
+		if w.seen&bit != 0 {
+			return false
+		}
+		w.seen |= bit
+		return true
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplayMapAccept(t *testing.T) {
+	tests := []struct {
+		name   string
+		seqs   []uint64 // accepted in order before seq
+		seq    uint64
+		accept bool
+	}{
+		{"first", nil, 100, true},
+		{"next", []uint64{100}, 101, true},
+		{"gap", []uint64{100}, 150, true},
+		{"duplicate", []uint64{100}, 100, false},
+		{"duplicate below highest", []uint64{100, 99, 101}, 99, false},
+		{"late within window", []uint64{100, 110}, 105, true},
+		{"oldest in window", []uint64{100, 100 + REPLAY_WINDOW - 1}, 100, false},
+		{"just outside window", []uint64{200}, 200 - REPLAY_WINDOW, false},
+		{"too old", []uint64{1000}, 10, false},
+		{"shifted out of window", []uint64{100, 101, 101 + REPLAY_WINDOW}, 101, false},
+		{"unseen after shift", []uint64{100, 101, 101 + REPLAY_WINDOW}, 102, true},
+		{"window shifted keeps bits", []uint64{100, 105}, 100, false},
+		{"window reset by big jump", []uint64{100, 100 + 2*REPLAY_WINDOW}, 100 + REPLAY_WINDOW + 1, true},
+	}
+
+	for _, test := range tests {
+		var replays tsReplayMap
+		for _, seq := range test.seqs {
+			if !replays.Accept(1, seq) {
+				t.Fatalf("%s: Accept(%d) = false while setting up", test.name, seq)
+			}
+		}
+		if accept := replays.Accept(1, test.seq); accept != test.accept {
+			t.Errorf("%s: Accept(%d) after %v = %v, want %v",
+				test.name, test.seq, test.seqs, accept, test.accept)
+		}
+	}
+}
+
+func TestReplayMapPerServer(t *testing.T) {
+	var replays tsReplayMap
+	if !replays.Accept(1, 100) || !replays.Accept(2, 100) {
+		t.Error("the same sequence number from two servers was rejected")
+	}
+	if replays.Accept(1, 100) || replays.Accept(2, 100) {
+		t.Error("a replayed sequence number was accepted")
+	}
+}
+
+func TestAuthenticateKeyRotation(t *testing.T) {
+	oldKey := []byte("0123456789abcdef-old")
+	newKey := []byte("0123456789abcdef-new")
+	otherKey := []byte("0123456789abcdef-other")
+	defer func(keys [][]byte) { CLUSTER_KEYS = keys }(CLUSTER_KEYS)
+	defer func(replays map[int]*replayWindow) { Replays.value = replays }(Replays.value)
+
+	seq := uint64(0)
+	envelopeTo := func(to int, key []byte, rts time.Time) *Envelope {
+		seq++
+		CLUSTER_KEYS = [][]byte{key}
+		env := &Envelope{Version: PROTOCOL_VERSION, Type: "vote", Id: 7, To: to, Rts: rts,
+			Body: []byte(`{"yes":true}`), Seq: seq}
+		sign(env)
+		return env
+	}
+	envelope := func(key []byte, rts time.Time) *Envelope {
+		return envelopeTo(ID, key, rts)
+	}
+
+	now := time.Now()
+	tests := []struct {
+		name  string
+		env   *Envelope
+		valid bool
+	}{
+		// while rotating, envelopes signed with either key are accepted
+		{"new key", envelope(newKey, now), true},
+		{"old key", envelope(oldKey, now), true},
+		{"other key", envelope(otherKey, now), false},
+		{"unsigned", &Envelope{Version: PROTOCOL_VERSION, Type: "vote", Id: 7, Rts: now, Seq: 100}, false},
+		{"stale", envelope(newKey, now.Add(-2*MAX_ENVELOPE_AGE)), false},
+		{"from the future", envelope(newKey, now.Add(2*MAX_ENVELOPE_AGE)), false},
+		// an envelope sent to another server cannot be replayed to this one
+		{"other receiver", envelopeTo(ID+1, newKey, now), false},
+	}
+	tampered := envelope(oldKey, now)
+	tampered.Body = []byte(`{"yes":false}`)
+	tests = append(tests, struct {
+		name  string
+		env   *Envelope
+		valid bool
+	}{"tampered", tampered, false})
+
+	Replays.value = nil
+	CLUSTER_KEYS = [][]byte{newKey, oldKey}
+	for _, test := range tests {
+		if err := authenticate(test.env); (err == nil) != test.valid {
+			t.Errorf("%s: authenticate = %v, want valid: %v", test.name, err, test.valid)
+		}
+	}
+
+	// replays are rejected whichever key they were signed with
+	for _, test := range tests[:2] {
+		if err := authenticate(test.env); err == nil {
+			t.Errorf("%s: replayed envelope accepted", test.name)
+		}
+	}
+}
+
+func TestAuthenticateHello(t *testing.T) {
+	defer func(keys [][]byte) { CLUSTER_KEYS = keys }(CLUSTER_KEYS)
+	defer func(replays map[int]*replayWindow) { Replays.value = replays }(Replays.value)
+	defer func(id int) { ID = id }(ID)
+	Replays.value = nil
+	CLUSTER_KEYS = [][]byte{[]byte("0123456789abcdef")}
+
+	// server 7 says hello to server 1
+	ID = 7
+	h := localHello()
+	signHello(&h, 1)
+	ID = 1
+
+	if err := authenticateHello(hello{}, 7); err == nil {
+		t.Error("unsigned hello accepted")
+	}
+	if err := authenticateHello(h, 8); err == nil {
+		t.Error("hello accepted from another server than its sender")
+	}
+	if err := authenticateHello(h, 7); err != nil {
+		t.Errorf("authenticateHello = %v", err)
+	}
+	if err := authenticateHello(h, 7); err == nil {
+		t.Error("replayed hello accepted")
+	}
+}
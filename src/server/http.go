@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"protocol"
+)
+
+// Servers started with "-http <addr>" (or with an "http" address in the
+// cluster configuration file) also serve an HTTP/JSON API on <addr>:
+//
+//  - "GET /songs":                the local playlist ({"<song>": "<url>", ...})
+//  - "GET /songs/<song>":         the url of <song> (like "get <song>")
+//  - "PUT /songs/<song>":         add <song> with the url in the body
+//                                 ({"url": "<url>"}, like "add <song> <url>")
+//  - "DELETE /songs/<song>":      delete <song> (like "delete <song>")
+//  - "GET /status":               the server's view of the cluster
+//  - "GET /transactions/<txn>":   the state of the transaction with id <txn>
+//  - "POST /admin/crash-points":  set a crash point ({"point": "crashVoteREQ",
+//                                 "args": ["1", "2"]}, like "crashVoteREQ 1 2";
+//                                 501 if the crash point is a stub, and 202
+//                                 before exiting if it crashes right away)
+//
+// "PUT" and "DELETE" requests with a "Request-Id: <id>" header can be retried
+// safely: the retries get the outcome of the original request (like "add <song>
+// <url> req=<id>", see replayRequest).
+//
+// Requests are carried out by the same code as the master commands (e.g. songs
+// are added by the coordinator, see forward), and their replies are translated
+// into JSON:
+//
+//  - "resp <url>" -> 200 {"song": "<song>", "url": "<url>"} (or 404 if the song
+//    doesn't exist)
+//  - "ack <commit|abort> <details>" -> 200 (or 409 Conflict if the transaction
+//    aborted) {"txn": "<txn>", "state": "<commit|abort>", "reason": ...,
+//    "ids": [...]}, see outcome
+//  - "err <code> <message>" -> 400, 409, 501, 503 or 504 (see errorStatus)
+//    {"error": "<code>", "message": "<message>"}
+
+// txnStatus is the state of a transaction as reported by the HTTP API
+type txnStatus struct {
+	Txn    string     `json:"txn,omitempty"`
+	State  string     `json:"state"`            // "in-flight", "uncertain", "committable", "commit" or "abort"
+	Op     *Operation `json:"op,omitempty"`     // operation of the transaction (if known)
+	Reason string     `json:"reason,omitempty"` // why the transaction aborted (see outcome)
+	Ids    []int      `json:"ids,omitempty"`    // servers that caused the abort
+}
+
+// serverStatus is the response to "GET /status"
+type serverStatus struct {
+	Id           int                  `json:"id"`
+	Coordinator  int                  `json:"coordinator"`
+	Epoch        int                  `json:"epoch"`
+	SteppingDown bool                 `json:"stepping_down,omitempty"`
+	Members      []int                `json:"members"`
+	Alive        []int                `json:"alive"`
+	Logged       uint64               `json:"logged"` // length of the log of chat messages
+	InFlight     map[string]Operation `json:"in_flight,omitempty"`
+}
+
+// apiError is the body of an error response
+type apiError struct {
+	Code    string `json:"error"`
+	Message string `json:"message"`
+}
+
+// serveHTTP serves the HTTP API on HTTP_ADDR
+func serveHTTP() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/songs", handleSongs)
+	mux.HandleFunc("/songs/", handleSong)
+	mux.HandleFunc("/status", handleStatus)
+	mux.HandleFunc("/transactions/", handleTransaction)
+	mux.HandleFunc("/admin/crash-points", handleCrashPoints)
+
+	if err := http.ListenAndServe(HTTP_ADDR, mux); err != nil {
+		Fatal("failed to serve the HTTP API on ", HTTP_ADDR, ": ", err)
+	}
+}
+
+// handleSongs serves "GET /songs"
+func handleSongs(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	writeJSON(w, http.StatusOK, LocalPlaylist.Copy())
+}
+
+// handleSong serves "GET", "PUT" and "DELETE /songs/<song>"
+func handleSong(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET", "PUT", "DELETE") {
+		return
+	}
+	song, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/songs/"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{ERR_MALFORMED, err.Error()})
+		return
+	}
+
+	var reply bytes.Buffer
+	var req []string
+	if id := r.Header.Get("Request-Id"); id != "" {
+		req = []string{"req=" + id}
+	}
+	switch r.Method {
+	case "GET":
+		if validSong(&reply, song) {
+			getCoordinator(&reply, song)
+		}
+	case "PUT":
+		var body struct {
+			Url string `json:"url"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeJSON(w, http.StatusBadRequest, apiError{ERR_MALFORMED, err.Error()})
+			return
+		}
+		args := append([]string{"add", song, body.Url}, req...)
+		if validSong(&reply, song) && validUrl(&reply, body.Url) && validRequestId(&reply, args, 3) {
+			forward(&reply, args)
+		}
+	case "DELETE":
+		args := append([]string{"delete", song}, req...)
+		if validSong(&reply, song) && validRequestId(&reply, args, 2) {
+			forward(&reply, args)
+		}
+	}
+	writeReply(w, song, reply.String())
+}
+
+// handleStatus serves "GET /status"
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	coordinator, epoch := Coordinator.Get()
+	writeJSON(w, http.StatusOK, serverStatus{
+		Id:           ID,
+		Coordinator:  coordinator,
+		Epoch:        epoch,
+		SteppingDown: steppingDown(),
+		Members:      Members.Ids(),
+		Alive:        LastTimestamp.GetAlive(time.Now()),
+		Logged:       MessagesFIFO.Len(),
+		InFlight:     InFlight.Copy(),
+	})
+}
+
+// handleTransaction serves "GET /transactions/<txn>" from the transactions
+// this server is taking part in and its DT log
+//
+// NOTE: servers only know about the transactions they took part in
+func handleTransaction(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	txn := strings.TrimPrefix(r.URL.Path, "/transactions/")
+
+	if op, ok := InFlight.Copy()[txn]; ok {
+		writeJSON(w, http.StatusOK, txnStatus{Txn: txn, State: "in-flight", Op: &op})
+		return
+	}
+
+	record, ok := readTxnFromLog(txn)
+	if !ok || len(record) < 3 {
+		writeJSON(w, http.StatusNotFound,
+			apiError{"not-found", "no such transaction: " + protocol.QuoteField(txn)})
+		return
+	}
+
+	// the record is "<state> <op> <args> <details>" (see writeDecision)
+	op, details := parseRecord(record)
+	status := parseDetails(details)
+	status.Op = &op
+	switch status.State = record[0]; status.State {
+	case "yes":
+		status.State = "uncertain"
+	case "pre-commit":
+		status.State = "committable"
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// handleCrashPoints serves "POST /admin/crash-points"
+func handleCrashPoints(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "POST") {
+		return
+	}
+	var body struct {
+		Point string   `json:"point"`
+		Args  []string `json:"args"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{ERR_MALFORMED, err.Error()})
+		return
+	} else if !strings.HasPrefix(body.Point, "crash") {
+		writeJSON(w, http.StatusBadRequest,
+			apiError{ERR_INVALID_ARG, "invalid crash point: " + protocol.QuoteField(body.Point)})
+		return
+	}
+
+	args := append([]string{body.Point}, body.Args...)
+	if crashesNow(args) {
+		// reply (in full, so that the client doesn't see a truncated
+		// response) before crashing
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusAccepted)
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+
+	var reply bytes.Buffer
+	setCrashPoint(&reply, args)
+	writeReply(w, "", reply.String())
+}
+
+// writeReply translates the reply to a master command (e.g. "ack commit
+// txn=<txn>") into a JSON response (see http.go)
+func writeReply(w http.ResponseWriter, song, reply string) {
+	fields := strings.Fields(reply)
+	if len(fields) == 0 {
+		writeJSON(w, http.StatusInternalServerError, apiError{ERR_FAILED, "no reply"})
+		return
+	}
+
+	switch fields[0] {
+	case "ok":
+		writeJSON(w, http.StatusOK, struct{}{})
+	case "resp":
+		if len(fields) < 2 || fields[1] == "NONE" {
+			writeJSON(w, http.StatusNotFound,
+				apiError{"not-found", "no such song: " + protocol.QuoteField(song)})
+			return
+		}
+		writeJSON(w, http.StatusOK, struct {
+			Song string `json:"song"`
+			Url  string `json:"url"`
+		}{song, fields[1]})
+	case "ack":
+		var status txnStatus
+		if len(fields) > 2 {
+			status = parseDetails(fields[2:])
+		}
+		if status.State = "commit"; len(fields) < 2 || fields[1] != "commit" {
+			status.State = "abort"
+			writeJSON(w, http.StatusConflict, status)
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+	case "err":
+		// the message is the rest of the reply (spaces included)
+		var e apiError
+		if parts := strings.SplitN(strings.TrimSpace(reply), " ", 3); len(parts) == 3 {
+			e.Code, e.Message = parts[1], parts[2]
+		} else if len(parts) == 2 {
+			e.Code = parts[1]
+		}
+		writeJSON(w, errorStatus(e.Code), e)
+	default:
+		writeJSON(w, http.StatusInternalServerError,
+			apiError{ERR_FAILED, "unexpected reply: " + strings.TrimSpace(reply)})
+	}
+}
+
+// parseDetails returns the status of a transaction carried by the <key>=<value>
+// fields of an outcome (see outcome.fields)
+func parseDetails(fields []string) txnStatus {
+	var status txnStatus
+	for _, field := range fields {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "txn":
+			status.Txn = kv[1]
+		case "reason":
+			status.Reason = kv[1]
+		case "ids":
+			status.Ids, _ = protocol.ParseIds(kv[1])
+		}
+	}
+	return status
+}
+
+// errorStatus returns the HTTP status code of the error response with the
+// given code (see replyError)
+func errorStatus(code string) int {
+	switch code {
+	case ERR_UNKNOWN_COMMAND, ERR_MALFORMED, ERR_MISSING_ARGS, ERR_INVALID_ARG:
+		return http.StatusBadRequest
+	case ERR_NOT_COORDINATOR, ERR_BUSY:
+		return http.StatusServiceUnavailable
+	case ERR_TIMEOUT:
+		return http.StatusGatewayTimeout
+	case ERR_NOT_IMPLEMENTED:
+		return http.StatusNotImplemented
+	case ERR_FAILED:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// allowMethods returns true if the method of r is one of the given methods
+// (and responds with 405 Method Not Allowed otherwise)
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeJSON(w, http.StatusMethodNotAllowed,
+		apiError{"method-not-allowed", r.Method + " is not allowed"})
+	return false
+}
+
+// writeJSON writes v as the JSON body of a response with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
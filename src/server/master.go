@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// master sessions                                                           //
+///////////////////////////////////////////////////////////////////////////////
+
+// Any number of master processes (e.g. the test master, an operator and a
+// monitoring script) can be connected to a server at the same time. The reply
+// to a command (e.g. "resp <url>" or "ack commit") is written to the session
+// that issued it once the command completes, while notifications are written to
+// every subscribed session. Sessions are subscribed when they connect, and can
+// unsubscribe with "unsubscribe" (and subscribe again with "subscribe").
+//
+// Every command receives exactly one terminal response: its result (e.g.
+// "resp <url>" or "ack commit txn=<txn>"), "ok" for commands that have none
+// (e.g. "broadcast"), or "err <code> <message>" if it is invalid or could not
+// be carried out, where <code> is one of
+//
+//  - "unknown-command": the command doesn't exist
+//  - "malformed":       the command can't be parsed (e.g. an unterminated
+//                       quoted string) or is empty (e.g. a tag alone)
+//  - "missing-args":    the command has too few arguments
+//  - "invalid-arg":     an argument is invalid (e.g. an empty song name, a url
+//                       containing whitespace, an unknown server id or a
+//                       request id already used for another operation)
+//  - "not-coordinator": the command must be sent to the coordinator, whose id
+//                       (or -1 if it is unknown) starts the message, e.g. "err
+//                       not-coordinator 1 the coordinator is 1"
+//  - "busy":            the coordinator is stepping down, or the transaction
+//                       of a retried request is still in progress
+//  - "timeout":         another server failed to respond in time (e.g. no
+//                       coordinator could be reached to forward an add to)
+//  - "failed":          the command was refused for another reason (e.g. the
+//                       target of a stepdown is not alive)
+//  - "not-implemented": the command exists but does nothing yet (e.g. most
+//                       crash points)
+//
+// The only exception is "crash", which never returns.
+//
+// A command can be tagged to tell its reply apart from those of other commands
+// (and from notifications): the reply to "#<tag> <command>" is "#<tag>
+// <reply>", e.g. "#7 get song" is answered with "#7 resp <url>".
+//
+// Notifications are events of the form "<kind> <args>":
+//
+//  - "coordinator <id>":                   the coordinator changed
+//  - "decision <commit|abort> <op> <args> <details>":
+//                                          a transaction was decided (e.g.
+//                                          "decision commit add song url
+//                                          txn=1.0.15", see outcome)
+//
+// Sessions that subscribe with "subscribe notify" get all of them as "notify
+// <kind> <args>" lines, which never collide with replies. Other subscribed
+// sessions only get "coordinator <id>" lines as they are (which the test master
+// relies on), since they may not expect any other lines.
+//
+// The last "coordinator <id>" notification raised while no session is
+// subscribed (or while writing to the subscribed sessions fails, e.g. because
+// the master is reconnecting) is kept in MessagesToMaster and written to the
+// next session that connects. Other notifications are only written to the
+// sessions subscribed at the time.
+
+// Codes of error responses (see replyError)
+const (
+	ERR_UNKNOWN_COMMAND = "unknown-command"
+	ERR_MALFORMED       = "malformed"
+	ERR_MISSING_ARGS    = "missing-args"
+	ERR_INVALID_ARG     = "invalid-arg"
+	ERR_NOT_COORDINATOR = "not-coordinator"
+	ERR_BUSY            = "busy"
+	ERR_TIMEOUT         = "timeout"
+	ERR_FAILED          = "failed"
+	ERR_NOT_IMPLEMENTED = "not-implemented"
+)
+
+// masterSession is a connection from a master process
+type masterSession struct {
+	conn       net.Conn
+	subscribed bool       // true if notifications are written to the session
+	prefixed   bool       // true if notifications are written as "notify ..."
+	tag        string     // tag of the command being executed (if any)
+	mutex      sync.Mutex // held while writing to conn
+}
+
+// Write writes p (one or more complete lines of a reply) to the master
+// process, tagging every line with the tag of the command being executed
+//
+// NOTE: writes are never interleaved, so replies and notifications always
+// arrive as whole lines
+func (s *masterSession) Write(p []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.tag == "" {
+		return s.write(p)
+	}
+	var buf bytes.Buffer
+	for _, line := range bytes.SplitAfter(p, []byte("\n")) {
+		if len(line) > 0 {
+			buf.WriteString(s.tag + " ")
+			buf.Write(line)
+		}
+	}
+	if _, err := s.write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// notify writes the notification of the given event to the master process
+func (s *masterSession) notify(event string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.prefixed {
+		event = "notify " + event
+	}
+	_, err := s.write([]byte(event + "\n"))
+	return err
+}
+
+// NOTE: s.mutex must be held
+func (s *masterSession) write(p []byte) (int, error) {
+	s.conn.SetWriteDeadline(time.Now().Add(TIMEOUT))
+	n, err := s.conn.Write(p)
+	if err != nil {
+		Error("failed to write to master ", s.conn.RemoteAddr(), ": ", err)
+	}
+	return n, err
+}
+
+// setTag sets the tag of the command being executed ("" if it is untagged)
+func (s *masterSession) setTag(tag string) {
+	s.mutex.Lock()
+	s.tag = tag
+	s.mutex.Unlock()
+}
+
+// replyError writes the error response "err <code> <message>" to w, where the
+// message is made of the given arguments (see fmt.Sprint)
+func replyError(w io.Writer, code string, msg ...interface{}) {
+	fmt.Fprintln(w, "err", code, fmt.Sprint(msg...))
+}
+
+// tsMasterSessions is the set of connected master sessions
+type tsMasterSessions struct {
+	value map[*masterSession]bool
+	mutex sync.Mutex // mutex for accessing contents
+}
+
+// Add registers a new session and writes the pending notifications to it
+func (tss *tsMasterSessions) Add(s *masterSession) {
+	tss.mutex.Lock()
+	defer tss.mutex.Unlock()
+
+	if tss.value == nil {
+		tss.value = make(map[*masterSession]bool)
+	}
+	tss.value[s] = true
+
+	for event := MessagesToMaster.Dequeue(); event != ""; event = MessagesToMaster.Dequeue() {
+		if err := s.notify(event); err != nil {
+			MessagesToMaster.PushFront(event)
+			return
+		}
+	}
+}
+
+func (tss *tsMasterSessions) Remove(s *masterSession) {
+	tss.mutex.Lock()
+	delete(tss.value, s)
+	tss.mutex.Unlock()
+}
+
+// Subscribe sets whether notifications are written to the given session (and
+// whether they are prefixed with "notify")
+func (tss *tsMasterSessions) Subscribe(s *masterSession, subscribed, prefixed bool) {
+	tss.mutex.Lock()
+	s.subscribed = subscribed
+	s.mutex.Lock()
+	s.prefixed = prefixed
+	s.mutex.Unlock()
+	tss.mutex.Unlock()
+}
+
+// Notify writes the notification of the given event to every session
+// subscribed to it, or keeps it for the next session if it is a coordinator
+// event and there are none (replacing the one kept before, if any)
+func (tss *tsMasterSessions) Notify(event string) {
+	tss.mutex.Lock()
+	defer tss.mutex.Unlock()
+
+	coordinator := strings.HasPrefix(event, "coordinator ")
+	delivered := false
+	for s := range tss.value {
+		if s.subscribed && (coordinator || s.prefixed) && s.notify(event) == nil {
+			delivered = true
+		}
+	}
+	if !delivered && coordinator {
+		for MessagesToMaster.Dequeue() != "" {
+		}
+		MessagesToMaster.Enqueue(event)
+	}
+}
+
+// serveMaster listens on MASTER_ADDR for connections from master processes
+// and services their commands
+func serveMaster() {
+	// Bind the master-facing port and start listening for commands
+	ln, err := net.Listen("tcp", MASTER_ADDR)
+	if err != nil {
+		Fatal("failed to bind master-facing port: ", MASTER_ADDR)
+	}
+
+	for {
+		masterConn, err := ln.Accept()
+		if err != nil {
+			continue
+		}
+
+		go handleMaster(masterConn)
+	}
+}
+
+// handleMaster executes commands from a master process and responds with any
+// requested data
+//
+// NOTE: the commands of a session are executed one at a time, while the
+// commands of different sessions are executed concurrently
+func handleMaster(masterConn net.Conn) {
+	defer masterConn.Close()
+	master := bufio.NewReader(masterConn)
+
+	s := &masterSession{conn: masterConn, subscribed: true}
+	Masters.Add(s)
+	defer Masters.Remove(s)
+
+	for {
+		command, err := master.ReadString('\n')
+		if err != nil {
+			// connection to master lost
+			return
+		}
+
+		command = strings.TrimSpace(command)
+		tag := ""
+		if strings.HasPrefix(command, "#") {
+			fields := strings.SplitN(command, " ", 2)
+			tag, command = fields[0], ""
+			if len(fields) == 2 {
+				command = strings.TrimSpace(fields[1])
+			}
+		}
+		s.setTag(tag)
+		execute(s, command)
+	}
+}
@@ -1,29 +1,458 @@
 package main
 
-import "time"
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"protocol"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// wire protocol                                                             //
+///////////////////////////////////////////////////////////////////////////////
+
+// Every message sent from one server to another is wrapped in an Envelope,
+// which is marshaled into JSON and prefixed by its length (a 4-byte big-endian
+// integer). Strings are never split on whitespace, so song names and urls may
+// contain arbitrary UTF-8.
+//
+// A stream carries the request that opened it followed by the replies (and
+// further requests) of the transaction it belongs to, e.g.
+//
+//  coordinator                     participant
+//  -----------                     -----------
+//  VoteReq            ->
+//                     <-           Vote
+//  PreCommit          ->
+//                     <-           Ack
+//  Decision           ->
+
+// Versions of the wire protocol:
+//  1: typed messages in length-prefixed envelopes
+//  2: servers exchange versions and features when they connect (see hello)
+//
+// Each pair of servers speaks the highest version both of them support, so
+// servers can be upgraded one at a time.
+const (
+	// Versions of the wire protocol spoken by this server
+	MIN_PROTOCOL_VERSION = 1
+	PROTOCOL_VERSION     = 2
+
+	// Maximum size of a marshaled envelope
+	MAX_MESSAGE_SIZE = 1 << 24
+)
+
+var (
+	// Features supported by this server (i.e. messages it understands
+	// beyond the basic 3PC ones)
+	//  - "handoff":    Handoff (see stepDown)
+	//  - "membership": StateTransfer and VoteReqs for configurations (see
+	//                  configCoordinator)
+	//  - "total-order": Messages are submitted to the sequencer (see
+	//                   order.go)
+	//  - "forward":    Forwards of master commands (see forward.go)
+	FEATURES = []string{"handoff", "membership", "total-order", "forward"}
+
+	// Features supported by servers that speak protocol version 1
+	V1_FEATURES = []string{"handoff", "membership"}
+)
+
+// Envelope carries a message along with its type and the sender's id and
+// real-time timestamp (by the sender's clock)
+type Envelope struct {
+	Version int             `json:"v"`    // version of the wire protocol
+	Type    string          `json:"type"` // type of the message in Body (see Payload)
+	Id      int             `json:"id"`   // server id of the sender
+	To      int             `json:"to"`   // server id of the receiver
+	Rts     time.Time       `json:"rts"`  // real-time timestamp
+	Body    json.RawMessage `json:"body"` // the message itself
+
+	Seq uint64 `json:"seq,omitempty"` // sequence number (see nextSeq)
+	Mac string `json:"mac,omitempty"` // HMAC of the above (see sign)
+}
+
+// Payload is implemented by every message that can be sent in an Envelope
+type Payload interface {
+	Type() string
+}
+
+// payloadTypes maps the type of an envelope to a constructor for its message
+var payloadTypes = map[string]func() Payload{
+	"message":        func() Payload { return new(Message) },
+	"get":            func() Payload { return new(Get) },
+	"get-resp":       func() Payload { return new(GetResp) },
+	"vote-req":       func() Payload { return new(VoteReq) },
+	"vote":           func() Payload { return new(Vote) },
+	"pre-commit":     func() Payload { return new(PreCommit) },
+	"ack":            func() Payload { return new(Ack) },
+	"decision":       func() Payload { return new(Decision) },
+	"state-req":      func() Payload { return new(StateReq) },
+	"state-report":   func() Payload { return new(StateReport) },
+	"handoff":        func() Payload { return new(Handoff) },
+	"state-transfer": func() Payload { return new(StateTransfer) },
+	"refusal":        func() Payload { return new(Refusal) },
+	"log-req":        func() Payload { return new(LogReq) },
+	"log":            func() Payload { return new(LogResp) },
+	"forward":        func() Payload { return new(Forward) },
+	"forward-resp":   func() Payload { return new(ForwardResp) },
+}
+
+// marshalMessage wraps p in an envelope of the given protocol version,
+// numbered for the server with the given id (see nextSeq), and returns it with
+// its length prefix
+func marshalMessage(p Payload, version, to int) ([]byte, error) {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+
+	env := &Envelope{
+		Version: version,
+		Type:    p.Type(),
+		Id:      ID,
+		To:      to,
+		Rts:     time.Now(),
+		Body:    body,
+		Seq:     nextSeq(to),
+	}
+	sign(env)
+
+	b, err := json.Marshal(env)
+	if err != nil {
+		return nil, err
+	} else if len(b) > MAX_MESSAGE_SIZE {
+		return nil, errors.New("message too large")
+	}
+
+	frame := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(frame, uint32(len(b)))
+	copy(frame[4:], b)
+	return frame, nil
+}
+
+// writeMessage sends p to w (see marshalMessage) in the protocol version
+// spoken by the server at the other end of w
+func writeMessage(w io.Writer, p Payload) error {
+	version, to := PROTOCOL_VERSION, -1
+	if stream, ok := w.(*muxStream); ok {
+		version, to = stream.session.version, stream.session.peer
+	}
+
+	b, err := marshalMessage(p, version, to)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// readMessage reads the next envelope from r and returns it along with the
+// message it carries
+//
+// NOTE: r is read without buffering, so that the following messages can be
+// read from r by somebody else
+func readMessage(r io.Reader) (*Envelope, Payload, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, nil, err
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if size > MAX_MESSAGE_SIZE {
+		return nil, nil, errors.New("message too large")
+	}
+
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, nil, err
+	}
+
+	env := new(Envelope)
+	if err := json.Unmarshal(b, env); err != nil {
+		return nil, nil, err
+	} else if env.Version < MIN_PROTOCOL_VERSION || env.Version > PROTOCOL_VERSION {
+		return nil, nil, fmt.Errorf("unsupported protocol version %d", env.Version)
+	} else if err := authenticate(env); err != nil {
+		return nil, nil, err
+	}
+
+	newPayload, ok := payloadTypes[env.Type]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown message type \"%s\"", env.Type)
+	}
+	p := newPayload()
+	if err := json.Unmarshal(env.Body, p); err != nil {
+		return nil, nil, err
+	}
+
+	if msg, ok := p.(*Message); ok {
+		msg.Id = env.Id
+		msg.Rts = env.Rts
+	}
+	return env, p, nil
+}
+
+// errBlocked is returned by readReply if the coordinator of the termination
+// protocol refused to decide a transaction (see terminationProtocolCoordinatorBody)
+var errBlocked = errors.New("blocked")
+
+// readReply reads the next message from r and returns the vote, decision or
+// state it conveys, i.e. "yes", "no", "pre-commit", "commit", "abort", "ack" or
+// the state of a StateReport
+//
+// Returns an error if the message is a Refusal or not a reply at all.
+func readReply(r io.Reader) (string, error) {
+	_, p, err := readMessage(r)
+	if err != nil {
+		return "", err
+	}
+
+	switch p := p.(type) {
+	case *Vote:
+		if p.Yes {
+			return "yes", nil
+		}
+		return "no", nil
+	case *PreCommit:
+		return "pre-commit", nil
+	case *Ack:
+		return "ack", nil
+	case *Decision:
+		if p.Commit {
+			return "commit", nil
+		}
+		return "abort", nil
+	case *StateReport:
+		return p.State, nil
+	case *Refusal:
+		if p.Reason == errBlocked.Error() {
+			return "", errBlocked
+		}
+		return "", errors.New(p.Reason)
+	default:
+		return "", fmt.Errorf("unexpected %s message", p.Type())
+	}
+}
+
+// expectAck returns nil if p is an Ack (and an error explaining why the
+// request was not acknowledged otherwise)
+func expectAck(p Payload) error {
+	switch p := p.(type) {
+	case *Ack:
+		return nil
+	case *Refusal:
+		return errors.New(p.Reason)
+	default:
+		return fmt.Errorf("unexpected %s message", p.Type())
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// messages                                                                  //
+///////////////////////////////////////////////////////////////////////////////
 
 // Message represents a message sent from one server to another
+//
+// Empty messages (i.e. heartbeats) also gossip the sender's view of the
+// cluster: its coordinator, the epoch in which that coordinator was chosen, the
+// servers it believes are operational, and the transactions it is currently
+// taking part in. They are numbered (see nextBeat) and echo the last heartbeat
+// received from every server (see clock.go). Non-empty messages carry a vector
+// clock and, once the sequencer numbered them, their position in the total
+// order instead (see order.go).
+//
+// Every message is numbered by the connection it is sent over, so that the
+// receiver handles the messages of each sender in the order in which they were
+// sent (see receive).
 type Message struct {
-	Id          int       `json:"id"`  // server id
-	Rts         time.Time `json:"rts"` // real-time timestamp
-	Content     string    `json:"msg"` // content of the message
-	coordinator int       `json:"c"`   // id of the coordinator
+	Id          int                  `json:"-"`              // server id (see Envelope)
+	Rts         time.Time            `json:"-"`              // real-time timestamp (see Envelope)
+	Content     string               `json:"msg"`            // content of the message
+	Coordinator int                  `json:"c"`              // id of the sender's coordinator
+	Epoch       int                  `json:"e"`              // epoch of the sender's coordinator
+	Up          []int                `json:"up,omitempty"`   // ids of servers the sender believes are alive
+	InFlight    map[string]Operation `json:"txn,omitempty"`  // sender's in-flight transactions (by id)
+	Beat        uint64               `json:"beat,omitempty"` // sequence number of a heartbeat
+	Echo        map[int]echo         `json:"echo,omitempty"` // last heartbeat received from each server (by id)
+	Logged      uint64               `json:"log,omitempty"`  // length of the sender's log of messages (see order.go)
+	Origin      int                  `json:"from,omitempty"` // id of the server that broadcast a non-empty message
+	Clock       vclock               `json:"vc,omitempty"`   // vector clock of a non-empty message (see causal.go)
+	Order       uint64               `json:"ord,omitempty"`  // position of a non-empty message in the total order
+	Seq         uint64               `json:"seq,omitempty"`  // position among the messages sent over the connection (see sendMessage)
 }
 
-// emptyMessage returns an empty message with a timestamp of time.Now()
+// emptyMessage returns an empty message with a timestamp of time.Now() that
+// carries the server's current view of the cluster
 func emptyMessage() *Message {
+	now := time.Now()
+	coordinator, epoch := Coordinator.Get()
 	return &Message{
 		Id:          ID,
-		Rts:         time.Now(),
-		coordinator: COORDINATOR,
+		Rts:         now,
+		Coordinator: coordinator,
+		Epoch:       epoch,
+		Up:          LastTimestamp.GetAlive(now),
+		InFlight:    InFlight.Copy(),
+		Beat:        nextBeat(),
+		Echo:        LastTimestamp.Echoes(),
+		Logged:      MessagesFIFO.Len(),
 	}
 }
 
 // newMessage returns a message with Content msg and a timestamp of time.Now()
 func newMessage(msg string) *Message {
+	coordinator, epoch := Coordinator.Get()
 	return &Message{
-		Id:      ID,
-		Rts:     time.Now(),
-		Content: msg,
+		Id:          ID,
+		Rts:         time.Now(),
+		Content:     msg,
+		Coordinator: coordinator,
+		Epoch:       epoch,
 	}
 }
+
+// Operation is the change to the playlist or to the configuration that a
+// transaction makes
+type Operation struct {
+	Kind   string `json:"op"`               // "add", "delete" or "config"
+	Song   string `json:"song,omitempty"`   // song to add or delete
+	Url    string `json:"url,omitempty"`    // url of the song to add
+	Config string `json:"config,omitempty"` // ids of the new configuration (e.g. "0,1,2")
+	Req    string `json:"req,omitempty"`    // id of the client request (see replayRequest)
+}
+
+// key returns the song or configuration the DT log records of the operation
+// are looked up by (see readVoteOrDecisionFromLog)
+func (op Operation) key() string {
+	if op.Kind == "config" {
+		return op.Config
+	}
+	return op.Song
+}
+
+// args returns the arguments of the operation as written to the DT log
+func (op Operation) args() []interface{} {
+	switch op.Kind {
+	case "add":
+		return []interface{}{op.Song, op.Url}
+	case "config":
+		return []interface{}{op.Config}
+	}
+	return []interface{}{op.Song}
+}
+
+// String returns the operation in the form of a DT log record (e.g. "add
+// <song> <url>")
+func (op Operation) String() string {
+	args := []string{op.Kind}
+	for _, arg := range op.args() {
+		args = append(args, protocol.QuoteField(arg.(string)))
+	}
+	return strings.Join(args, " ")
+}
+
+// Get asks for the url of a song
+type Get struct {
+	Song string `json:"song"`
+}
+
+// GetResp is the url of the song asked for by a Get (or "NONE")
+type GetResp struct {
+	Url string `json:"url"`
+}
+
+// VoteReq asks a participant to vote on a transaction
+type VoteReq struct {
+	Txn string    `json:"txn"` // id of the transaction
+	Op  Operation `json:"op"`  // operation of the transaction
+}
+
+// Vote is a participant's vote on a transaction
+type Vote struct {
+	Yes bool `json:"yes"`
+}
+
+// PreCommit tells a participant that every participant voted yes
+type PreCommit struct{}
+
+// Ack acknowledges a PreCommit, StateTransfer or Handoff
+type Ack struct{}
+
+// Decision is the outcome of a transaction
+type Decision struct {
+	Commit bool `json:"commit"` // false if the transaction aborted
+}
+
+// StateReq asks a participant for its state in a transaction (see the
+// termination protocol)
+type StateReq struct {
+	Txn string    `json:"txn,omitempty"` // id of the transaction (if known)
+	Op  Operation `json:"op"`            // operation of the transaction
+}
+
+// StateReport is a participant's state in a transaction: "abort", "commit",
+// "pre-commit" or "uncertain"
+type StateReport struct {
+	State string `json:"state"`
+}
+
+// Handoff asks a server to become the coordinator of the given epoch (see
+// stepDown)
+type Handoff struct {
+	Epoch int `json:"epoch"`
+}
+
+// StateTransfer is the state sent to a server that is joining the cluster
+type StateTransfer struct {
+	Members  []int             `json:"members"`
+	Playlist map[string]string `json:"playlist"`
+}
+
+// Refusal is sent instead of an Ack if a request cannot be carried out
+type Refusal struct {
+	Reason string `json:"reason"`
+}
+
+// LogReq asks for the messages in the log of a server starting from the given
+// position (see catchUp)
+type LogReq struct {
+	From uint64 `json:"from"`
+}
+
+// LogResp is the part of the log asked for by a LogReq
+type LogResp struct {
+	Messages []*Message `json:"msgs"`
+}
+
+// Forward asks the coordinator to execute a master command on behalf of
+// another server (see forward)
+type Forward struct {
+	Args []string `json:"args"`
+}
+
+// ForwardResp is the reply of the coordinator to a forwarded command
+type ForwardResp struct {
+	Reply string `json:"reply"`
+}
+
+func (*Message) Type() string       { return "message" }
+func (*Get) Type() string           { return "get" }
+func (*GetResp) Type() string       { return "get-resp" }
+func (*VoteReq) Type() string       { return "vote-req" }
+func (*Vote) Type() string          { return "vote" }
+func (*PreCommit) Type() string     { return "pre-commit" }
+func (*Ack) Type() string           { return "ack" }
+func (*Decision) Type() string      { return "decision" }
+func (*StateReq) Type() string      { return "state-req" }
+func (*StateReport) Type() string   { return "state-report" }
+func (*Handoff) Type() string       { return "handoff" }
+func (*StateTransfer) Type() string { return "state-transfer" }
+func (*Refusal) Type() string       { return "refusal" }
+func (*LogReq) Type() string        { return "log-req" }
+func (*LogResp) Type() string       { return "log" }
+func (*Forward) Type() string       { return "forward" }
+func (*ForwardResp) Type() string   { return "forward-resp" }
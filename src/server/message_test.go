@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	op := Operation{Kind: "add", Song: "日本 の 歌 \"live\"", Url: "http://example.com/ü?a=b c", Req: "r.1"}
+	tests := []Payload{
+		&Message{Content: "héllo wörld ☕\n\ttabs", Coordinator: 1, Epoch: 2,
+			Up: []int{0, 1}, InFlight: map[string]Operation{"2.1.5": op}, Order: 7, Seq: 3},
+		&Get{Song: "my song"},
+		&GetResp{Url: "NONE"},
+		&VoteReq{Txn: "0.0.1", Op: op},
+		&Vote{Yes: true},
+		&PreCommit{},
+		&Ack{},
+		&Decision{Commit: true},
+		&StateReq{Op: Operation{Kind: "config", Config: "0,1,2"}},
+		&StateReport{State: "uncertain"},
+		&Handoff{Epoch: 3},
+		&StateTransfer{Members: []int{0, 2}, Playlist: map[string]string{"a b": "http://x"}},
+		&Refusal{Reason: "blocked"},
+		&LogReq{From: 4},
+		&LogResp{Messages: []*Message{{Content: "m0", Order: 1}}},
+		&Forward{Args: []string{"add", "my song", "http://x", "req=1.2"}},
+		&ForwardResp{Reply: "ack commit txn=0.0.1"},
+	}
+
+	for _, p := range tests {
+		for version := MIN_PROTOCOL_VERSION; version <= PROTOCOL_VERSION; version++ {
+			b, err := marshalMessage(p, version, 1)
+			if err != nil {
+				t.Fatalf("marshalMessage(%s): %v", p.Type(), err)
+			}
+
+			r := bytes.NewReader(b)
+			env, got, err := readMessage(r)
+			if err != nil {
+				t.Fatalf("readMessage(%s): %v", p.Type(), err)
+			} else if r.Len() != 0 {
+				t.Errorf("readMessage(%s) left %d bytes unread", p.Type(), r.Len())
+			}
+			if env.Version != version || env.Type != p.Type() || env.Id != ID {
+				t.Errorf("readMessage(%s): envelope = %+v", p.Type(), env)
+			}
+
+			if msg, ok := got.(*Message); ok {
+				// set from the envelope
+				if msg.Id != ID || !msg.Rts.Equal(env.Rts) {
+					t.Errorf("readMessage(message): id %d, rts %v", msg.Id, msg.Rts)
+				}
+				msg.Id, msg.Rts = p.(*Message).Id, p.(*Message).Rts
+			}
+			if !reflect.DeepEqual(got, p) {
+				t.Errorf("readMessage(%s) = %+v, want %+v", p.Type(), got, p)
+			}
+		}
+	}
+}
+
+func TestReadMessageErrors(t *testing.T) {
+	frame := func(env interface{}) []byte {
+		b, _ := json.Marshal(env)
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.BigEndian, uint32(len(b)))
+		buf.Write(b)
+		return buf.Bytes()
+	}
+	valid, _ := marshalMessage(&Vote{Yes: true}, PROTOCOL_VERSION, -1)
+	tooLarge := make([]byte, 4)
+	binary.BigEndian.PutUint32(tooLarge, MAX_MESSAGE_SIZE+1)
+
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"empty", nil},
+		{"truncated length", valid[:2]},
+		{"truncated body", valid[:len(valid)-1]},
+		{"too large", tooLarge},
+		{"not json", append([]byte{0, 0, 0, 3}, "{{{"...)},
+		{"old version", frame(Envelope{Version: MIN_PROTOCOL_VERSION - 1, Type: "vote", Body: []byte("{}")})},
+		{"new version", frame(Envelope{Version: PROTOCOL_VERSION + 1, Type: "vote", Body: []byte("{}")})},
+		{"unknown type", frame(Envelope{Version: PROTOCOL_VERSION, Type: "gossip", Body: []byte("{}")})},
+		{"bad body", frame(Envelope{Version: PROTOCOL_VERSION, Type: "vote", Body: []byte(`{"yes":1}`)})},
+	}
+
+	for _, test := range tests {
+		if _, _, err := readMessage(bytes.NewReader(test.b)); err == nil {
+			t.Errorf("readMessage(%s) succeeded", test.name)
+		}
+	}
+
+	// a truncated frame is reported as such, so that the stream is dropped
+	if _, _, err := readMessage(bytes.NewReader(valid[:2])); err != io.ErrUnexpectedEOF {
+		t.Errorf("readMessage(truncated length) = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestMarshalMessageTooLarge(t *testing.T) {
+	content := string(bytes.Repeat([]byte("a"), MAX_MESSAGE_SIZE))
+	if _, err := marshalMessage(&Message{Content: content}, PROTOCOL_VERSION, -1); err == nil {
+		t.Error("marshalMessage succeeded for a message larger than MAX_MESSAGE_SIZE")
+	}
+}
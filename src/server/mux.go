@@ -0,0 +1,916 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Servers talk to each other over long-lived TCP connections (one in each
+// direction for every pair of servers) instead of dialing a new connection for
+// every message.
+//
+// Each connection (a muxSession) carries any number of streams. A stream plays
+// the role of a single short-lived connection: the dialer opens it, sends a
+// request, reads the response(s) and closes it. Streams implement net.Conn, so
+// the protocol code doesn't need to know about multiplexing.
+//
+// Every frame on a connection has the following format:
+//
+//  +-----------+----------+-----------+----------------+
+//  | stream id | type     | length    | payload        |
+//  | (4 bytes) | (1 byte) | (4 bytes) | (length bytes) |
+//  +-----------+----------+-----------+----------------+
+//
+// The stream id correlates requests and responses. The first frame sent by the
+// dialer is a frameHello whose stream id is the dialer's server id, and whose
+// payload lists the protocol versions and features the dialer supports (see
+// hello). The other server replies with a frameHello of its own (or refuses the
+// connection) before any streams are opened.
+//
+// If TLS is enabled, connections are wrapped in TLS before the frameHello (see
+// tls.go). If HMAC keys are configured, both frameHellos are signed (see
+// signHello), so that a connection cannot claim another server's id.
+
+const (
+	frameHello = iota // announces a server's id, versions and features
+	frameOpen         // opens a new stream
+	frameData         // carries (part of) a stream's data
+	frameClose        // closes a stream
+
+	// Maximum size of a frame's payload
+	MAX_FRAME_SIZE = 1 << 20
+
+	// Bounds of the delay between attempts to connect to a server that is
+	// unreachable
+	MIN_DIAL_BACKOFF = 50 * time.Millisecond
+	MAX_DIAL_BACKOFF = 1 * time.Second
+)
+
+var (
+	Peers peerPool // connections to other servers
+
+	errStreamClosed  = errors.New("stream closed")
+	errSessionClosed = errors.New("connection to server lost")
+)
+
+// timeoutError is returned when a deadline on a stream or muxListener expires
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+///////////////////////////////////////////////////////////////////////////////
+// connection pool                                                           //
+///////////////////////////////////////////////////////////////////////////////
+
+// peerPool holds this server's outgoing connections to other servers
+type peerPool struct {
+	sessions map[int]*muxSession // keyed by server id
+	incoming map[int]*muxSession // last connection accepted from each server
+	dialing  map[int]*dialCall   // connections being set up, keyed by server id
+	backoff  map[int]*dialBackoff
+	v1       map[int]bool // servers that announced protocol version 1 (see hello)
+	mutex    sync.Mutex   // mutex for accessing contents
+}
+
+// dialCall is an attempt to connect to a server, whose result is shared by
+// everybody who asks for the connection in the meantime
+type dialCall struct {
+	done    chan struct{} // closed once the attempt is over
+	session *muxSession
+	err     error
+}
+
+// dialBackoff delays new attempts to connect to an unreachable server
+type dialBackoff struct {
+	delay time.Duration
+	next  time.Time // time of the next attempt
+}
+
+// dialPeer opens a new stream to the server with the given id, connecting to it
+// first if there is no connection yet
+//
+// If a previous attempt to connect failed, then no new attempt is made until
+// a (exponentially increasing) backoff has elapsed.
+func dialPeer(id int) (net.Conn, error) {
+	session, err := Peers.session(id)
+	if err != nil {
+		return nil, err
+	}
+	return session.open()
+}
+
+// session returns the connection to the server with the given id, connecting
+// to it if necessary
+//
+// NOTE: connecting (and the TLS and protocol handshakes) happens without
+// holding the pool's mutex, so that a server that is slow to respond only
+// delays those who are waiting for a connection to it.
+func (pp *peerPool) session(id int) (*muxSession, error) {
+	pp.mutex.Lock()
+	if session, ok := pp.sessions[id]; ok {
+		pp.mutex.Unlock()
+		return session, nil
+	}
+	if pp.sessions == nil {
+		pp.sessions = make(map[int]*muxSession)
+		pp.dialing = make(map[int]*dialCall)
+		pp.backoff = make(map[int]*dialBackoff)
+	}
+
+	if call, ok := pp.dialing[id]; ok {
+		pp.mutex.Unlock()
+		<-call.done
+		return call.session, call.err
+	}
+	b := pp.backoff[id]
+	if b != nil && time.Now().Before(b.next) {
+		pp.mutex.Unlock()
+		return nil, errors.New("server " + strconv.Itoa(id) + " is unreachable")
+	}
+	call := &dialCall{done: make(chan struct{})}
+	pp.dialing[id] = call
+	pp.mutex.Unlock()
+
+	call.session, call.err = connect(id)
+
+	pp.mutex.Lock()
+	delete(pp.dialing, id)
+	if call.err != nil {
+		if b == nil {
+			b = &dialBackoff{delay: MIN_DIAL_BACKOFF}
+			pp.backoff[id] = b
+		} else if b.delay *= 2; b.delay > MAX_DIAL_BACKOFF {
+			b.delay = MAX_DIAL_BACKOFF
+		}
+		b.next = time.Now().Add(b.delay)
+	} else {
+		delete(pp.backoff, id)
+		pp.sessions[id] = call.session
+	}
+	pp.mutex.Unlock()
+	close(call.done)
+
+	if call.err != nil {
+		return nil, call.err
+	}
+	go func() {
+		call.session.serve()
+		pp.remove(id, call.session)
+	}()
+	return call.session, nil
+}
+
+// connect connects to the server with the given id and returns a session that
+// speaks the protocol version agreed upon (see handshake)
+func connect(id int) (*muxSession, error) {
+	conn, err := net.DialTimeout("tcp", peerAddr(id), HEARTBEAT_INTERVAL)
+	if err != nil {
+		return nil, err
+	}
+	if TLS_CONFIG != nil {
+		tc, err := tlsClient(conn, id)
+		if err != nil {
+			Error("TLS handshake with server ", id, " failed: ", err)
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+
+	session, err := handshake(conn, id)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return session, nil
+}
+
+// accepted records session as the last connection accepted from its peer, and
+// whether the peer announced protocol version 1 (see acceptHello)
+func (pp *peerPool) accepted(session *muxSession, v1 bool) {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+
+	if pp.v1 == nil {
+		pp.v1 = make(map[int]bool)
+		pp.incoming = make(map[int]*muxSession)
+	}
+	pp.incoming[session.peer] = session
+	pp.v1[session.peer] = v1
+}
+
+// isV1 returns true if the server with the given id announced protocol version
+// 1 when it last connected to this server
+func (pp *peerPool) isV1(id int) bool {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+	return pp.v1[id]
+}
+
+// owns returns true if session is this server's current connection to or from
+// its peer (rather than e.g. one that was replaced by a newer connection), and
+// forgets it if it was accepted from the peer
+func (pp *peerPool) owns(session *muxSession) bool {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+
+	if pp.incoming[session.peer] == session {
+		delete(pp.incoming, session.peer)
+		return true
+	}
+	return pp.sessions[session.peer] == session
+}
+
+// remove forgets the given (closed) connection to the server with the given id
+func (pp *peerPool) remove(id int, session *muxSession) {
+	pp.mutex.Lock()
+	if pp.sessions[id] == session {
+		delete(pp.sessions, id)
+	}
+	pp.mutex.Unlock()
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// listener                                                                  //
+///////////////////////////////////////////////////////////////////////////////
+
+// muxListener accepts streams opened by other servers over their connections
+// to this server
+//
+// NOTE: streams are queued without bound, so that a busy server never stops
+// reading from its connections (which would block the streams it is using)
+type muxListener struct {
+	ln       net.Listener
+	pending  []*muxStream  // streams that have not been accepted yet (FIFO)
+	notify   chan struct{} // signals new streams or deadline changes
+	deadline time.Time
+	mutex    sync.Mutex // mutex for accessing pending and deadline
+}
+
+// listenPeers binds the server-facing address and starts accepting connections
+// from other servers
+func listenPeers(addr string) (*muxListener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mln := &muxListener{ln: ln, notify: make(chan struct{}, 1)}
+	go mln.acceptSessions()
+	return mln, nil
+}
+
+func (mln *muxListener) acceptSessions() {
+	for {
+		conn, err := mln.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			if TLS_CONFIG != nil {
+				tc, err := tlsServer(conn)
+				if err != nil {
+					Error("TLS handshake with ", conn.RemoteAddr(), " failed: ", err)
+					conn.Close()
+					return
+				}
+				conn = tc
+			}
+
+			// the first frame identifies the dialer
+			r := bufio.NewReader(conn)
+			conn.SetReadDeadline(time.Now().Add(ALIVE_INTERVAL))
+			id, typ, payload, err := readFrame(r)
+			if err != nil || typ != frameHello {
+				conn.Close()
+				return
+			}
+			conn.SetReadDeadline(time.Time{})
+			if err := verifyPeerId(conn, int(id)); err != nil {
+				Error("refused connection from server ", id, ": ", err)
+				conn.Close()
+				return
+			}
+
+			session := newMuxSession(conn, int(id), mln)
+			session.r = r
+			if err := session.acceptHello(payload); err != nil {
+				Error("refused connection from server ", id, ": ", err)
+				conn.Close()
+				return
+			}
+			session.serve()
+		}()
+	}
+}
+
+// enqueue queues a stream opened by another server
+func (mln *muxListener) enqueue(stream *muxStream) {
+	mln.mutex.Lock()
+	mln.pending = append(mln.pending, stream)
+	mln.mutex.Unlock()
+	mln.signal()
+}
+
+// signal wakes up a blocked Accept
+func (mln *muxListener) signal() {
+	select {
+	case mln.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Accept returns the next stream opened by another server
+func (mln *muxListener) Accept() (net.Conn, error) {
+	for {
+		mln.mutex.Lock()
+		if len(mln.pending) > 0 {
+			stream := mln.pending[0]
+			mln.pending = mln.pending[1:]
+			mln.mutex.Unlock()
+			return stream, nil
+		}
+		deadline := mln.deadline
+		mln.mutex.Unlock()
+
+		var timeout <-chan time.Time
+		var t *time.Timer
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return nil, timeoutError{}
+			}
+			t = time.NewTimer(d)
+			timeout = t.C
+		}
+
+		select {
+		case <-mln.notify:
+		case <-timeout:
+		}
+		if t != nil {
+			t.Stop()
+		}
+	}
+}
+
+// SetDeadline sets the deadline for future Accept calls (a zero value means
+// Accept won't time out)
+func (mln *muxListener) SetDeadline(t time.Time) error {
+	mln.mutex.Lock()
+	mln.deadline = t
+	mln.mutex.Unlock()
+	mln.signal()
+	return nil
+}
+
+func (mln *muxListener) Close() error   { return mln.ln.Close() }
+func (mln *muxListener) Addr() net.Addr { return mln.ln.Addr() }
+
+///////////////////////////////////////////////////////////////////////////////
+// handshake                                                                 //
+///////////////////////////////////////////////////////////////////////////////
+
+// hello is the payload of a frameHello, with which two servers agree on the
+// version of the wire protocol (see Envelope) and learn which features the
+// other server supports
+//
+// NOTE: servers that speak protocol version 1 send an empty frameHello and
+// don't reply to one, so they are assumed to support V1_FEATURES. A server that
+// doesn't reply is only assumed to speak version 1 if it announced so (i.e. it
+// sent an empty frameHello) when it connected to this server, since it may just
+// be slow.
+type hello struct {
+	MinVersion int      `json:"min"`
+	MaxVersion int      `json:"max"`
+	Features   []string `json:"features,omitempty"`
+	Error      string   `json:"error,omitempty"` // why the connection was refused
+
+	// set if HMAC keys are configured (see signHello)
+	Rts int64  `json:"rts,omitempty"` // in nanoseconds since the epoch
+	Seq uint64 `json:"seq,omitempty"`
+	Mac string `json:"mac,omitempty"`
+}
+
+// signHello signs h (sent to the server with the given id) like an envelope
+// (see sign), if HMAC keys are configured
+func signHello(h *hello, to int) {
+	if CLUSTER_KEYS == nil {
+		return
+	}
+	h.Rts, h.Seq = time.Now().UnixNano(), nextSeq(to)
+	env := helloEnvelope(*h, ID, to)
+	sign(env)
+	h.Mac = env.Mac
+}
+
+// authenticateHello returns an error if HMAC keys are configured and h (sent
+// by the server with the given id) is unsigned, forged or replayed (see
+// authenticate)
+func authenticateHello(h hello, from int) error {
+	return authenticate(helloEnvelope(h, from, ID))
+}
+
+// helloEnvelope returns the envelope whose HMAC is that of h
+func helloEnvelope(h hello, from, to int) *Envelope {
+	mac := h.Mac
+	h.Mac = ""
+	body, _ := json.Marshal(h)
+	return &Envelope{Type: "hello", Id: from, To: to, Rts: time.Unix(0, h.Rts),
+		Body: body, Seq: h.Seq, Mac: mac}
+}
+
+func localHello() hello {
+	return hello{
+		MinVersion: MIN_PROTOCOL_VERSION,
+		MaxVersion: PROTOCOL_VERSION,
+		Features:   FEATURES,
+	}
+}
+
+// negotiate returns the highest protocol version spoken by both this server
+// and the server with the given id, which sent h
+func negotiate(h hello, peer int) (int, error) {
+	version := PROTOCOL_VERSION
+	if h.MaxVersion < version {
+		version = h.MaxVersion
+	}
+	if version < MIN_PROTOCOL_VERSION || version < h.MinVersion {
+		return 0, fmt.Errorf("no common protocol version (server %d speaks "+
+			"versions %d-%d, server %d speaks versions %d-%d)",
+			peer, h.MinVersion, h.MaxVersion, ID, MIN_PROTOCOL_VERSION, PROTOCOL_VERSION)
+	}
+	return version, nil
+}
+
+// handshake sends a frameHello over conn (a new connection to the server with
+// the given id) and returns a session that speaks the version agreed upon
+func handshake(conn net.Conn, id int) (*muxSession, error) {
+	h := localHello()
+	signHello(&h, id)
+	payload, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(HEARTBEAT_INTERVAL))
+	defer conn.SetDeadline(time.Time{})
+	if err := writeFrame(conn, uint32(ID), frameHello, payload); err != nil {
+		return nil, err
+	}
+
+	session := newMuxSession(conn, id, nil)
+	_, typ, payload, err := readFrame(session.r)
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		if session.r.Buffered() > 0 || !Peers.isV1(id) {
+			// the server is slow to reply (and may have sent part
+			// of a frame), so the connection cannot be used
+			return nil, fmt.Errorf("server %d did not reply to hello", id)
+		}
+		// the server speaks protocol version 1 (see hello)
+		session.setPeer(1, V1_FEATURES)
+		return session, nil
+	} else if err != nil {
+		return nil, err
+	} else if typ != frameHello {
+		return nil, errors.New("unexpected frame during handshake")
+	}
+
+	if err := json.Unmarshal(payload, &h); err != nil {
+		return nil, err
+	} else if err := authenticateHello(h, id); err != nil {
+		return nil, err
+	} else if h.Error != "" {
+		err := fmt.Errorf("server %d refused the connection: %s", id, h.Error)
+		Error(err)
+		return nil, err
+	}
+
+	version, err := negotiate(h, id)
+	if err != nil {
+		Error("cannot talk to server ", id, ": ", err)
+		return nil, err
+	}
+	session.setPeer(version, h.Features)
+	return session, nil
+}
+
+// acceptHello replies to the frameHello (with the given payload) sent by the
+// server that dialed this session, refusing the connection if the two servers
+// have no protocol version in common
+func (s *muxSession) acceptHello(payload []byte) error {
+	if len(payload) == 0 {
+		// the server speaks protocol version 1 (see hello), which
+		// cannot sign its hello
+		if CLUSTER_KEYS != nil {
+			return authenticateHello(hello{}, s.peer)
+		}
+		Peers.accepted(s, true)
+		s.setPeer(1, V1_FEATURES)
+		return nil
+	}
+
+	var h hello
+	if err := json.Unmarshal(payload, &h); err != nil {
+		return err
+	} else if err := authenticateHello(h, s.peer); err != nil {
+		return err
+	}
+
+	reply := localHello()
+	version, err := negotiate(h, s.peer)
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	signHello(&reply, s.peer)
+	replyPayload, merr := json.Marshal(reply)
+	if merr != nil {
+		return merr
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(HEARTBEAT_INTERVAL))
+	werr := writeFrame(s.conn, uint32(ID), frameHello, replyPayload)
+	s.conn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		return err
+	} else if werr != nil {
+		return werr
+	}
+
+	Peers.accepted(s, false)
+	s.setPeer(version, h.Features)
+	return nil
+}
+
+// peerSupports returns true if the server with the given id (which this server
+// connects to if necessary) supports the given feature (see FEATURES)
+func peerSupports(id int, feature string) bool {
+	session, err := Peers.session(id)
+	if err != nil {
+		return false
+	}
+	return session.features[feature]
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// session                                                                   //
+///////////////////////////////////////////////////////////////////////////////
+
+// muxSession is a connection to another server that carries streams
+type muxSession struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	peer     int                   // id of the server at the other end
+	version  int                   // protocol version spoken with the peer
+	features map[string]bool       // features supported by the peer
+	accept   *muxListener          // where streams opened by the peer go
+	streams  map[uint32]*muxStream // open streams, keyed by stream id
+	nextId   uint32                // id of the next stream opened by this server
+	sent     uint64                // number of Messages sent (see sendMessage)
+	inbox    tsInbox               // Messages received (see receive)
+	closed   bool
+	mutex    sync.Mutex // mutex for accessing streams, nextId, sent and closed
+	wmutex   sync.Mutex // mutex for writing to conn
+}
+
+// newMuxSession returns a session over conn to the server with the given id.
+// Streams opened by the other server are queued in accept (if accept is nil,
+// then only this server can open streams).
+func newMuxSession(conn net.Conn, peer int, accept *muxListener) *muxSession {
+	return &muxSession{
+		conn:    conn,
+		r:       bufio.NewReader(conn),
+		peer:    peer,
+		accept:  accept,
+		streams: make(map[uint32]*muxStream),
+	}
+}
+
+// setPeer records the protocol version agreed upon with the peer and the
+// features it supports (see handshake)
+func (s *muxSession) setPeer(version int, features []string) {
+	s.version = version
+	s.features = make(map[string]bool, len(features))
+	for _, feature := range features {
+		s.features[feature] = true
+	}
+}
+
+// serve reads frames and dispatches them to streams until the connection is
+// lost (see close)
+func (s *muxSession) serve() {
+	defer s.close()
+
+	for {
+		id, typ, payload, err := readFrame(s.r)
+		if err != nil {
+			return
+		}
+
+		s.mutex.Lock()
+		stream, ok := s.streams[id]
+		if !ok && typ == frameOpen && s.accept != nil {
+			stream = newMuxStream(s, id)
+			s.streams[id] = stream
+		}
+		s.mutex.Unlock()
+
+		switch {
+		case typ == frameOpen && !ok && stream != nil:
+			s.accept.enqueue(stream)
+		case typ == frameData && stream != nil:
+			stream.deliver(payload)
+		case typ == frameClose && stream != nil:
+			stream.closeRemote()
+		}
+	}
+}
+
+// open opens a new stream to the peer
+func (s *muxSession) open() (*muxStream, error) {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil, errSessionClosed
+	}
+	s.nextId++
+	stream := newMuxStream(s, s.nextId)
+	s.streams[stream.id] = stream
+	s.mutex.Unlock()
+
+	if err := s.write(stream.id, frameOpen, nil, time.Now().Add(TIMEOUT)); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// nextMessageSeq returns the sequence number of the next Message sent to the
+// peer (see Message.Seq)
+func (s *muxSession) nextMessageSeq() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sent++
+	return s.sent
+}
+
+// write sends a frame to the peer
+func (s *muxSession) write(id uint32, typ byte, payload []byte, deadline time.Time) error {
+	s.wmutex.Lock()
+	defer s.wmutex.Unlock()
+
+	s.conn.SetWriteDeadline(deadline)
+	err := writeFrame(s.conn, id, typ, payload)
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			// a partially written frame corrupts the connection
+			s.conn.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+// close closes the connection and all of its streams, and marks the peer dead
+// if this was its current connection (see peerPool.owns)
+func (s *muxSession) close() {
+	s.mutex.Lock()
+	s.closed = true
+	streams := s.streams
+	s.streams = make(map[uint32]*muxStream)
+	s.mutex.Unlock()
+
+	s.conn.Close()
+	for _, stream := range streams {
+		stream.fail(errSessionClosed)
+	}
+	if Peers.owns(s) {
+		LastTimestamp.MarkDead(s.peer)
+	}
+}
+
+// forget removes a (closed) stream from the session
+func (s *muxSession) forget(id uint32) {
+	s.mutex.Lock()
+	delete(s.streams, id)
+	s.mutex.Unlock()
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// stream                                                                    //
+///////////////////////////////////////////////////////////////////////////////
+
+// muxStream is a bidirectional stream of bytes over a muxSession
+type muxStream struct {
+	session *muxSession
+	id      uint32
+
+	buf           bytes.Buffer  // data received but not yet read
+	notify        chan struct{} // signals new data, closure or deadline changes
+	remoteClosed  bool          // the peer closed the stream
+	localClosed   bool          // this server closed the stream
+	err           error         // set if the session was lost
+	readDeadline  time.Time
+	writeDeadline time.Time
+	mutex         sync.Mutex // mutex for accessing the fields above
+}
+
+func newMuxStream(session *muxSession, id uint32) *muxStream {
+	return &muxStream{
+		session: session,
+		id:      id,
+		notify:  make(chan struct{}, 1),
+	}
+}
+
+// signal wakes up a blocked Read
+func (st *muxStream) signal() {
+	select {
+	case st.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (st *muxStream) deliver(payload []byte) {
+	st.mutex.Lock()
+	st.buf.Write(payload)
+	st.mutex.Unlock()
+	st.signal()
+}
+
+func (st *muxStream) closeRemote() {
+	st.mutex.Lock()
+	st.remoteClosed = true
+	st.mutex.Unlock()
+	st.signal()
+}
+
+func (st *muxStream) fail(err error) {
+	st.mutex.Lock()
+	st.err = err
+	st.mutex.Unlock()
+	st.signal()
+}
+
+func (st *muxStream) Read(p []byte) (int, error) {
+	for {
+		st.mutex.Lock()
+		switch {
+		case st.buf.Len() > 0:
+			n, _ := st.buf.Read(p)
+			st.mutex.Unlock()
+			return n, nil
+		case st.remoteClosed:
+			st.mutex.Unlock()
+			return 0, io.EOF
+		case st.err != nil:
+			err := st.err
+			st.mutex.Unlock()
+			return 0, err
+		case st.localClosed:
+			st.mutex.Unlock()
+			return 0, errStreamClosed
+		}
+		deadline := st.readDeadline
+		st.mutex.Unlock()
+
+		var timeout <-chan time.Time
+		var t *time.Timer
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, timeoutError{}
+			}
+			t = time.NewTimer(d)
+			timeout = t.C
+		}
+
+		select {
+		case <-st.notify:
+		case <-timeout:
+		}
+		if t != nil {
+			t.Stop()
+		}
+	}
+}
+
+func (st *muxStream) Write(p []byte) (int, error) {
+	st.mutex.Lock()
+	closed, err, deadline := st.localClosed, st.err, st.writeDeadline
+	st.mutex.Unlock()
+	if closed {
+		return 0, errStreamClosed
+	} else if err != nil {
+		return 0, err
+	} else if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, timeoutError{}
+	}
+
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > MAX_FRAME_SIZE {
+			chunk = chunk[:MAX_FRAME_SIZE]
+		}
+		if err := st.session.write(st.id, frameData, chunk, deadline); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// Close closes the stream (any data that was received but not read is
+// discarded)
+func (st *muxStream) Close() error {
+	st.mutex.Lock()
+	if st.localClosed {
+		st.mutex.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	failed := st.err != nil
+	st.mutex.Unlock()
+	st.signal()
+
+	st.session.forget(st.id)
+	if failed {
+		return nil
+	}
+	return st.session.write(st.id, frameClose, nil, time.Now().Add(TIMEOUT))
+}
+
+func (st *muxStream) SetDeadline(t time.Time) error {
+	st.mutex.Lock()
+	st.readDeadline = t
+	st.writeDeadline = t
+	st.mutex.Unlock()
+	st.signal()
+	return nil
+}
+
+func (st *muxStream) SetReadDeadline(t time.Time) error {
+	st.mutex.Lock()
+	st.readDeadline = t
+	st.mutex.Unlock()
+	st.signal()
+	return nil
+}
+
+func (st *muxStream) SetWriteDeadline(t time.Time) error {
+	st.mutex.Lock()
+	st.writeDeadline = t
+	st.mutex.Unlock()
+	return nil
+}
+
+func (st *muxStream) LocalAddr() net.Addr  { return st.session.conn.LocalAddr() }
+func (st *muxStream) RemoteAddr() net.Addr { return st.session.conn.RemoteAddr() }
+
+///////////////////////////////////////////////////////////////////////////////
+// framing                                                                   //
+///////////////////////////////////////////////////////////////////////////////
+
+func writeFrame(w io.Writer, id uint32, typ byte, payload []byte) error {
+	frame := make([]byte, 9+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], id)
+	frame[4] = typ
+	binary.BigEndian.PutUint32(frame[5:9], uint32(len(payload)))
+	copy(frame[9:], payload)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+func readFrame(r *bufio.Reader) (id uint32, typ byte, payload []byte, err error) {
+	var header [9]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return
+	}
+
+	id = binary.BigEndian.Uint32(header[0:4])
+	typ = header[4]
+	length := binary.BigEndian.Uint32(header[5:9])
+	if length > MAX_FRAME_SIZE {
+		err = errors.New("frame too large")
+		return
+	}
+
+	payload = make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	return
+}
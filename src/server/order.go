@@ -0,0 +1,340 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Chat messages are delivered in the same order by every server, so that the
+// logs of all servers (see MessagesFIFO) are identical. The coordinator acts as
+// the sequencer:
+//
+//  1. a server that broadcasts a message submits it to the sequencer (see
+//     broadcast), and keeps it until it has been delivered
+//  2. the sequencer puts the messages it is submitted in causal order (see
+//     causal.go), numbers them consecutively (see Message.Order), delivers them
+//     and sends them to every other server
+//  3. every server delivers the messages from its sequencer in the order of
+//     their numbers, i.e. the position of message n in its log is n
+//
+// A server that misses messages (e.g. because it was down when they were sent)
+// fetches them from another server whose log is longer (see catchUp): every
+// server advertises the length of its log in its heartbeats, and the logs of
+// all servers are prefixes of one another.
+//
+// When the sequencer fails, the new coordinator first catches up with the
+// longest log of any live server and only then numbers new messages, starting
+// from the end of that log. Messages that were submitted to the old sequencer
+// but never delivered are submitted again after ALIVE_INTERVAL, and those it
+// numbered already are recognized by their vector clocks (see
+// tsCausalQueue.Add).
+//
+// NOTE: like the rest of the protocol, this assumes that failures are detected
+// accurately. A sequencer that is wrongly believed to have failed may number
+// messages alongside the new one until it learns about the new coordinator.
+//
+// NOTE: servers that don't support the "total-order" feature broadcast messages
+// to every server directly, so they are delivered in the order in which they
+// arrive.
+
+var Submissions = make(chan *Message, 100) // messages submitted to this server as the sequencer
+
+// pendingMessage is a message broadcast by this server that hasn't been
+// delivered yet
+type pendingMessage struct {
+	msg       *Message
+	submitted time.Time // when msg was last submitted to the sequencer
+}
+
+// tsTotalOrder delivers messages to MessagesFIFO in the order given by the
+// sequencer
+type tsTotalOrder struct {
+	held    map[uint64]*Message // messages that arrived before their predecessors
+	pending []pendingMessage    // messages broadcast by this server
+	logged  map[int]uint64      // length of the log of each server
+	synced  bool                // true once this server caught up as the sequencer...
+	epoch   int                 // ...of this epoch
+	mutex   sync.Mutex          // mutex for accessing contents
+}
+
+// Submit records that msg was broadcast by this server (and submitted to the
+// sequencer)
+func (tto *tsTotalOrder) Submit(msg *Message) {
+	tto.mutex.Lock()
+	tto.pending = append(tto.pending, pendingMessage{msg, time.Now()})
+	tto.mutex.Unlock()
+}
+
+// Resubmit returns the messages broadcast by this server that have not been
+// delivered within ALIVE_INTERVAL of being submitted (e.g. because the
+// sequencer failed), so that they can be submitted again
+func (tto *tsTotalOrder) Resubmit(now time.Time) []*Message {
+	tto.mutex.Lock()
+	defer tto.mutex.Unlock()
+
+	var msgs []*Message
+	for i, p := range tto.pending {
+		if now.Sub(p.submitted) >= ALIVE_INTERVAL {
+			tto.pending[i].submitted = now
+			msgs = append(msgs, p.msg)
+		}
+	}
+	return msgs
+}
+
+// Sequence numbers msg (as the sequencer) and delivers it
+func (tto *tsTotalOrder) Sequence(msg *Message) {
+	tto.mutex.Lock()
+	msg.Order = MessagesFIFO.Len() + 1
+	tto.deliver(msg)
+	tto.mutex.Unlock()
+}
+
+// Receive delivers msg (numbered by the sequencer) along with the messages
+// held back until it arrived, or holds it back until its predecessors arrive
+//
+// Returns false if messages are missing (see catchUp).
+func (tto *tsTotalOrder) Receive(msg *Message) bool {
+	tto.mutex.Lock()
+	defer tto.mutex.Unlock()
+
+	if msg.Order > MessagesFIFO.Len() {
+		if tto.held == nil {
+			tto.held = make(map[uint64]*Message)
+		}
+		tto.held[msg.Order] = msg
+	}
+	tto.deliverHeld()
+	return len(tto.held) == 0
+}
+
+// Append delivers msgs, the messages of another server's log starting from the
+// given position (see catchUp)
+func (tto *tsTotalOrder) Append(from uint64, msgs []*Message) {
+	tto.mutex.Lock()
+	defer tto.mutex.Unlock()
+
+	for i, msg := range msgs {
+		if msg.Order = from + uint64(i); msg.Order == MessagesFIFO.Len()+1 {
+			tto.deliver(msg)
+		}
+	}
+	tto.deliverHeld()
+}
+
+// DeliverUnordered delivers a message from a server that doesn't support total
+// order broadcast
+func (tto *tsTotalOrder) DeliverUnordered(msg *Message) {
+	tto.mutex.Lock()
+	MessagesFIFO.Enqueue(msg)
+	tto.mutex.Unlock()
+}
+
+// deliverHeld delivers held messages for as long as the next one is there, and
+// forgets those that were delivered already (e.g. by catching up)
+//
+// NOTE: tto.mutex must be held
+func (tto *tsTotalOrder) deliverHeld() {
+	for {
+		for n := range tto.held {
+			if n <= MessagesFIFO.Len() {
+				delete(tto.held, n)
+			}
+		}
+
+		msg, ok := tto.held[MessagesFIFO.Len()+1]
+		if !ok {
+			return
+		}
+		delete(tto.held, msg.Order)
+		tto.deliver(msg)
+	}
+}
+
+// deliver adds msg to MessagesFIFO
+//
+// NOTE: tto.mutex must be held
+func (tto *tsTotalOrder) deliver(msg *Message) {
+	MessagesFIFO.Enqueue(msg)
+	Causal.Delivered(msg)
+
+	if msg.Origin != ID {
+		return
+	}
+	for i, p := range tto.pending {
+		if p.msg.Clock[ID] == msg.Clock[ID] {
+			tto.pending = append(tto.pending[:i], tto.pending[i+1:]...)
+			break
+		}
+	}
+}
+
+// Advertised records the length of the log of the server with the given id,
+// and returns true if it is longer than this server's log
+func (tto *tsTotalOrder) Advertised(id int, length uint64) bool {
+	tto.mutex.Lock()
+	defer tto.mutex.Unlock()
+
+	if tto.logged == nil {
+		tto.logged = make(map[int]uint64)
+	}
+	tto.logged[id] = length
+	return length > MessagesFIFO.Len()
+}
+
+// Longest returns the id of the live server with the longest log, if it is
+// longer than this server's log (and -1 otherwise)
+func (tto *tsTotalOrder) Longest() int {
+	tto.mutex.Lock()
+	defer tto.mutex.Unlock()
+
+	longest, length := -1, MessagesFIFO.Len()
+	for id, n := range tto.logged {
+		if n > length && LastTimestamp.IsAlive(id) {
+			longest, length = id, n
+		}
+	}
+	return longest
+}
+
+// Synced returns true if this server caught up as the sequencer of the current
+// epoch
+func (tto *tsTotalOrder) Synced() bool {
+	tto.mutex.Lock()
+	defer tto.mutex.Unlock()
+	return tto.synced && tto.epoch == Coordinator.Epoch()
+}
+
+// SetSynced records that this server caught up as the sequencer of the given
+// epoch
+func (tto *tsTotalOrder) SetSynced(epoch int) {
+	tto.mutex.Lock()
+	tto.synced, tto.epoch = true, epoch
+	tto.mutex.Unlock()
+}
+
+// submit submits a message broadcast by this server to the sequencer
+//
+// NOTE: messages that cannot be submitted (e.g. because the sequencer is
+// unknown or unreachable) are submitted again later (see order)
+func submit(msg *Message) {
+	switch coordinator := Coordinator.Id(); coordinator {
+	case -1:
+	case ID:
+		enqueueSubmission(msg)
+	default:
+		sendMessage(msg, coordinator)
+	}
+}
+
+// enqueueSubmission queues msg to be numbered by this server as the sequencer,
+// or drops it (and counts it in Metrics) if too many messages are waiting to be
+// numbered, in which case its submitter submits it again later (see Resubmit)
+func enqueueSubmission(msg *Message) {
+	select {
+	case Submissions <- msg:
+	default:
+		Metrics.Add("dropped_submissions", 1)
+	}
+}
+
+// order numbers the messages submitted to this server while it is the
+// sequencer, delivers messages that were held back for too long (see
+// tsCausalQueue.Expire), and submits the messages broadcast by this server
+// again if they were not delivered in time
+func order() {
+	ticker := time.NewTicker(HEARTBEAT_INTERVAL)
+	for {
+		select {
+		case msg := <-Submissions:
+			if Coordinator.Id() != ID || !syncSequencer() {
+				// the submitter will submit msg again
+				continue
+			}
+			for _, msg := range Causal.Add(msg) {
+				sequence(msg)
+			}
+
+		case now := <-ticker.C:
+			if Coordinator.Id() == ID && syncSequencer() {
+				for _, msg := range Causal.Expire(now) {
+					sequence(msg)
+				}
+			}
+			for _, msg := range Ordering.Resubmit(now) {
+				submit(msg)
+			}
+		}
+	}
+}
+
+// syncSequencer makes sure that this server caught up with the longest log of
+// any live server since it became the sequencer, and returns false if it
+// failed to
+func syncSequencer() bool {
+	if Ordering.Synced() {
+		return true
+	}
+
+	epoch := Coordinator.Epoch()
+	if id := Ordering.Longest(); id != -1 {
+		if err := catchUp(id); err != nil {
+			Error("sequencer failed to catch up with server ", id, ": ", err)
+			return false
+		}
+	}
+	Ordering.SetSynced(epoch)
+	return true
+}
+
+// sequence numbers msg (as the sequencer), delivers it and sends it to every
+// other server
+//
+// NOTE: messages are sent in the order of their numbers, since the servers
+// receive the messages of each sender in the order in which they were sent
+// (see receive)
+func sequence(msg *Message) {
+	Ordering.Sequence(msg)
+
+	ids := append(Members.Ids(), LastTimestamp.GetAliveNonMembers(time.Now())...)
+	for _, id := range ids {
+		if id != ID {
+			sendMessage(msg, id)
+		}
+	}
+}
+
+// catchUpLater catches up with the server with the given id (see catchUp) in
+// the background, so as not to hold up the messages of the server that
+// revealed the gap (see handleMessage), unless it is already doing so
+func catchUpLater(id int) {
+	// CatchingUp keeps every message received meanwhile (e.g. the rest of
+	// a burst from the sequencer) from fetching the same log again
+	if !CatchingUp.TryAdd(id) {
+		return
+	}
+	go func() {
+		defer CatchingUp.Remove(id)
+		if err := catchUp(id); err != nil {
+			Error("failed to catch up with server ", id, ": ", err)
+		}
+	}()
+}
+
+// catchUp fetches the messages that this server is missing from the log of the
+// server with the given id
+func catchUp(id int) error {
+	from := MessagesFIFO.Len() + 1
+	resp, err := sendAndWaitForResponse(&LogReq{From: from}, id)
+	if err != nil {
+		return err
+	}
+
+	msgs, ok := resp.(*LogResp)
+	if !ok {
+		return errors.New("unexpected " + resp.Type() + " message")
+	}
+	Ordering.Append(from, msgs.Messages)
+	return nil
+}
@@ -67,6 +67,28 @@ func (p *playlist) DeleteSong(song string) {
 	p.mutex.Unlock()
 }
 
+// Copy returns a copy of the songs (and their urls) in the playlist
+func (p *playlist) Copy() map[string]string {
+	p.mutex.Lock()
+	c := make(map[string]string, len(p.value))
+	for song, url := range p.value {
+		c[song] = url
+	}
+	p.mutex.Unlock()
+	return c
+}
+
+// Replace replaces the contents of the playlist with the given songs
+func (p *playlist) Replace(songs map[string]string) {
+	value := make(map[string]string, len(songs))
+	for song, url := range songs {
+		value[song] = url
+	}
+	p.mutex.Lock()
+	p.value = value
+	p.mutex.Unlock()
+}
+
 func (p *playlist) WritePlaylist(w io.Writer) {
 	p.mutex.Lock()
 	playlistJson, _ := json.Marshal(p.value)
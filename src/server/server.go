@@ -1,114 +1,260 @@
-// Server is an implementation of a distributed, FIFO consistent chatroom where
-// participants (servers) can broadcast messages and detect failures. Each
-// server keeps a FIFO log of messages it has received.
+// Server is an implementation of a distributed, causally consistent chatroom
+// where participants (servers) can broadcast messages and detect failures. Each
+// server keeps a log of the messages it has received in causal order (see
+// causal.go).
 //
 // "server [id] [numservers] [port]" sets up a server with ID [id] on port
 // [20000 + id] with a master-facing port of [port] (i.e the port which
 // the master process uses to issue commands and accept responses).
 // [numservers] is the total number of servers in the system, and is used to
 // connect to the remaining servers. A system of n servers is assumed to have
-// server IDs {0...n-1} and ports {20000...20000 + n-1} respectively.
+// server IDs {0...n-1} and ports {20000...20000 + n-1} respectively, until a
+// membership change (see "addServer" and "removeServer") is committed.
+//
+// "server [id] [numservers] [port] [config]" reads the addresses of the
+// servers, the initial configuration and the timeouts from the cluster
+// configuration file [config] instead (see clusterConfig).
+//
+// The same arguments (and a few more) can be provided as flags, e.g.
+// "server -id 0 -n 3 -port 30000 -logdir /tmp/logs -mode 2pc". Run
+// "server -h" for the full list. Servers authenticate each other with mutual
+// TLS if they are given a directory of certificates with "-tls <dir>" (see
+// gencerts). "-http <addr>" also serves an HTTP/JSON API on <addr> (see
+// http.go).
 //
 //  The following master commands are supported:
 //  --------------------------------------------
-//  - "get\n:               return a list of all received messages
+//  - "get <song>\n":       return the url of <song> (see getCoordinator)
+//  - "add <song> <url>\n", "delete <song>\n":
+//                          run a transaction as the coordinator (non-
+//                          coordinators forward them, see forward.go); a
+//                          trailing "req=<id>" makes a retried command return
+//                          the original outcome (see replayRequest)
+//  - "addServer <id>\n", "removeServer <id>\n", "stepdown [id]\n":
+//                          change the configuration or hand coordinatorship
+//                          over (coordinator only, see 3pc.go)
+//  - "messages\n":         return the log of chat messages
 //  - "alive\n":            return a list of server IDs believed to be alive
-//  - "broadcast <m>\n":    send <m> to everyone alive (including the sender)
+//  - "alive phi\n":        the same, along with their suspicion levels
+//  - "broadcast <m>\n":    send the chat message <m> to every server
+//                          (including the sender, see order.go)
+//  - "metrics\n":          return the values of the server's counters
+//  - "suspicion\n":        return how strongly other servers are suspected to
+//                          have failed (see detector.go)
+//  - "clock\n":            return the estimated offsets of the clocks of
+//                          other servers (see clock.go)
+//  - "subscribe [notify]\n", "unsubscribe\n":
+//                          start or stop receiving notifications (see
+//                          master.go)
 //
 //  Responses have the following format:
 //  ------------------------------------
-//  - "get\n"   -> "messages <msg1>,<msg2>,...\n"
+//  - "get <song>\n" -> "resp <url>\n" (or "resp NONE\n")
+//  - "add ...\n", "delete ...\n", "addServer ...\n", "removeServer ...\n" ->
+//    "ack commit txn=<txn>\n" or "ack abort txn=<txn> reason=<reason> ids=<ids>\n"
+//    (see outcome)
+//  - "messages\n" -> "messages <msg1>,<msg2>,...\n"
 //  - "alive\n" -> "alive <id1>,<id2>,...\n"
+//  - "alive phi\n" -> "alive <id1>:<phi1>,<id2>:<phi2>,...\n"
+//  - "metrics\n" -> "metrics <name1>=<value1>,<name2>=<value2>,...\n"
+//  - "suspicion\n" -> "suspicion <id1>=<phi1>,<id2>=<phi2>,...\n"
+//  - "clock\n" -> "clock <id1>=<offset1>/<roundtrip1>,...\n"
+//  - any other command -> "ok\n"
+//  - invalid or rejected commands -> "err <code> <message>\n" (see master.go)
 //
-// You can test a server instance using netcat. For example:
+// Several master processes can be connected at once. Responses are written to
+// the connection the command came from (tagged like the command, e.g. "#1 get
+// <song>\n" -> "#1 resp <url>\n"), while notifications such as "coordinator
+// <id>\n" are written to every subscribed connection.
+//
+// You can test a cluster with tpcctl, which sends the commands above to the
+// right server and prints their replies (see src/tpcctl), e.g. "tpcctl -config
+// cluster.json add song url", or a single server instance using netcat. For
+// example:
 //  ➜  server 0 1 30000 &
 //  [2] 43246
 //  ➜  netcat localhost 30000
-//  get                         (command)
+//  messages                    (command)
 //  messages
 //  alive                       (command)
 //  alive 0
 //  broadcast hello world       (command)
-//  get                         (command)
+//  ok
+//  messages                    (command)
 //  messages hello world
 //  ^C
+//
+// NOTE: the server shares the helpers of the text protocol with the client
+// library (see src/protocol), so it is built with the repository as the
+// GOPATH, e.g. "GOPATH=$PWD GO111MODULE=off go build -o process
+// ./src/server/" (see build).
 package main
 
 import (
-	"bufio"
 	"bytes"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
 	"os"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 )
 
 const (
+	// Constants for printing error messages to the terminal
+	BOLD_RED = "\033[31;1m"
+	NO_STYLE = "\033[0m"
+	ERROR    = "[" + BOLD_RED + "ERROR" + NO_STYLE + "]"
+)
+
+// Settings that can be changed by flags (or a cluster configuration file)
+var (
 	// Base port for servers in the system
-	// Port numbers are always START_PORT + ID
+	// Port numbers are START_PORT + ID (unless a cluster configuration
+	// file says otherwise)
 	START_PORT = 20000
 
+	// Directory for the DT logs
+	LOG_DIR = "logs"
+
+	// How a participant votes on an add: "length" (no if the url is longer
+	// than ID + 5 characters), "yes" or "no"
+	VOTE_POLICY = "length"
+
+	// "3pc" or "2pc" (i.e. 3PC without the pre-commit round)
+	PROTOCOL = "3pc"
+
 	// Duration between heartbeat messages (i.e. empty messages broadcasted
 	// to other servers to indicate the server is alive)
 	HEARTBEAT_INTERVAL = 200 * time.Millisecond
 
-	// Maximum interval after the send timestamp of the last message
-	// received from a server for which the sender is considered alive
-	ALIVE_INTERVAL = 200 * time.Millisecond
+	// Level of suspicion at which a server is considered dead (see
+	// detector.go)
+	//
+	// NOTE: if 0, servers are considered dead once ALIVE_INTERVAL has
+	// passed since their last message arrived instead
+	PHI_THRESHOLD = 8.0
+
+	// Maximum interval after the arrival of the last message received from
+	// a server for which the sender is considered alive (if PHI_THRESHOLD
+	// is 0)
+	//
+	// NOTE: this must leave room for a late heartbeat or two. If it were
+	// no longer than HEARTBEAT_INTERVAL, a heartbeat delayed by scheduling
+	// or a busy network alone would get its sender declared dead, and the
+	// election that follows is gossiped to (and adopted by) everyone, so
+	// that servers flap between coordinators.
+	ALIVE_INTERVAL = 3 * HEARTBEAT_INTERVAL
 
 	// Timeout for waiting for a response from the coordinator
 	TIMEOUT = 10 * time.Millisecond
 
-	// Constants for printing error messages to the terminal
-	BOLD_RED = "\033[31;1m"
-	NO_STYLE = "\033[0m"
-	ERROR    = "[" + BOLD_RED + "ERROR" + NO_STYLE + "]"
+	// Offset between the clocks of this server and another server beyond
+	// which an error is logged (see clock.go), or 0 for no limit
+	MAX_CLOCK_SKEW = 100 * time.Millisecond
+
+	// Directory of the certificates for mutual TLS between servers (TLS is
+	// disabled if empty)
+	TLS_DIR string
+
+	// File of the keys messages between servers are signed with (messages
+	// are not signed if empty, see hmac.go)
+	KEY_FILE string
+
+	// Address of the HTTP API (disabled if empty, see http.go)
+	HTTP_ADDR string
 )
 
 var (
-	ID                 = -1 // id of the server {0, ..., NUM_PROCS-1}
-	NUM_PROCS          = -1 // total number of servers
+	ID                 = -1 // id of the server
+	NUM_PROCS          = -1 // total number of servers (in the current configuration)
 	MASTER_PORT        = -1 // number of the master-facing port
 	REQUIRED_ARGUMENTS = []*int{&ID, &NUM_PROCS, &MASTER_PORT}
+	CONFIG_FILE        string // path of the cluster configuration file
+
+	PEER_ADDRS      = map[int]string{} // peer addresses from the cluster configuration file
+	MASTER_ADDR     string             // address of the master-facing port
+	INITIAL_MEMBERS []int              // ids of the servers in the initial configuration
 
-	PORT        = -1   // server's port number
-	COORDINATOR = -1   // coordinator's id number
-	DT_LOG      string // name of server's DT Log file
+	STEPPING_DOWN int32  // 1 while the coordinator hands off (see stepDown)
+	DT_LOG        string // name of server's DT Log file
+
+	Coordinator = tsCoordinator{id: -1} // coordinator's id and the epoch in which it was chosen
 
 	LocalPlaylist    playlist         // in-memory copy of server's playlist
-	MessagesFIFO     tsMsgQueue       // all received messages in FIFO order
-	LastTimestamp    tsTimestampQueue // timestamp of last message from each server
-	MessagesToMaster tsStringQueue    // pending messages to master
-	DeadLastRound    []bool           // DeadLastRound[i] == true if i was dead last round
+	MessagesFIFO     tsMsgQueue       // all received messages in causal order
+	Causal           tsCausalQueue    // messages waiting to be numbered by the sequencer
+	Ordering         tsTotalOrder     // messages waiting to be added to MessagesFIFO
+	CatchingUp       tsIdSet          // servers whose log is being fetched (see catchUpLater)
+	BroadcastMutex   sync.Mutex       // held while broadcasting a non-empty message
+	LastTimestamp    tsTimestampQueue // arrival time of last message from each server
+	MessagesToMaster tsStringQueue    // notifications waiting for a master session
+	Masters          tsMasterSessions // connected master sessions
+	InFlight         tsTxnMap         // transactions this server is taking part in
+	TxnMutex         sync.Mutex       // held by the coordinator while running a transaction
+	Members          tsMembers        // ids of the servers in the cluster
+	Metrics          tsCounters       // counters of notable events (see the "metrics" command)
 )
 
-// init parses and validates command line arguments (by name or position) and
+// setup parses and validates command line arguments (by name or position) and
 // initializes global variables
-func init() {
+//
+// NOTE: this isn't done by init, so that tests don't parse the arguments of
+// the test binary.
+func setup() {
+	setArgsFlags()
 	setArgsPositional()
 
-	if NUM_PROCS <= 0 {
-		Fatal("invalid number of servers: ", NUM_PROCS)
+	if MASTER_PORT != -1 {
+		MASTER_ADDR = ":" + strconv.Itoa(MASTER_PORT)
+	}
+	if CONFIG_FILE != "" {
+		if err := loadConfig(CONFIG_FILE); err != nil {
+			Fatal("invalid cluster configuration: ", err)
+		}
+	}
+	if ALIVE_INTERVAL == 0 {
+		ALIVE_INTERVAL = 3 * HEARTBEAT_INTERVAL
+	}
+	validateArgs()
+
+	if TLS_DIR != "" {
+		if err := loadTLS(TLS_DIR); err != nil {
+			Fatal("invalid TLS configuration: ", err)
+		}
+	}
+	if KEY_FILE != "" {
+		if err := loadKeys(KEY_FILE); err != nil {
+			Fatal("invalid key file: ", err)
+		}
 	}
 
-	logDir := "logs"
+	// the initial configuration is {0...n-1} unless the cluster
+	// configuration file says otherwise
+	if INITIAL_MEMBERS == nil {
+		INITIAL_MEMBERS = make([]int, NUM_PROCS)
+		for id := range INITIAL_MEMBERS {
+			INITIAL_MEMBERS[id] = id
+		}
+	}
 
-	PORT = START_PORT + ID
-	DT_LOG = fmt.Sprintf("%s/dt_log_%0*d.log", logDir, len(os.Args[2]), ID)
+	DT_LOG = fmt.Sprintf("%s/dt_log_%0*d.log",
+		LOG_DIR, len(strconv.Itoa(NUM_PROCS)), ID)
 
 	LocalPlaylist = NewPlaylist()
 
-	LastTimestamp.value = make([]time.Time, NUM_PROCS)
-
-	DeadLastRound = make([]bool, NUM_PROCS)
+	// the cluster consists of the initial members unless a different
+	// configuration was committed to the DT log
+	if config, ok := readConfigFromLog(); ok {
+		Members.Set(config)
+	} else {
+		Members.Set(INITIAL_MEMBERS)
+	}
 
 	// make directories for storing logs and playlists
 	fileMode := os.ModePerm | os.ModeDir
-	os.Mkdir(logDir, fileMode)
+	os.MkdirAll(LOG_DIR, fileMode)
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -116,15 +262,21 @@ func init() {
 ///////////////////////////////////////////////////////////////////////////////
 
 func main() {
+	setup()
+
 	// bind the server-facing port
-	ln, err := net.Listen("tcp", ":"+strconv.Itoa(PORT))
+	ln, err := listenPeers(peerAddr(ID))
 	if err != nil {
-		Fatal("failed to bind server-facing port: ", strconv.Itoa(PORT))
+		Fatal("failed to bind server-facing port: ", peerAddr(ID))
 	}
 	determineInitialCoordinator(ln)
 
 	go fetchMessages(ln)
 	go heartbeat()
+	go order()
+	if HTTP_ADDR != "" {
+		go serveHTTP()
+	}
 	serveMaster()
 }
 
@@ -133,28 +285,37 @@ func determineInitialCoordinator(ln net.Listener) {
 	broadcast(emptyMessage())
 
 	// listen for messages from operational servers -> updating LastTimestamp
+	//
+	// the first heartbeat from a server that knows the coordinator tells
+	// us who it is (see gossip)
 	time.Sleep(HEARTBEAT_INTERVAL) // wait for other servers to spin up
-	for i := 0; i < NUM_PROCS*2; i++ {
-		lnr := (ln).(*net.TCPListener)
+	for end := time.Now().Add(ALIVE_INTERVAL); Coordinator.Id() == -1 && time.Now().Before(end); {
+		lnr := (ln).(*muxListener)
 		lnr.SetDeadline(time.Now().Add(TIMEOUT))
 		conn, err := lnr.Accept()
 		if err != nil {
 			continue
 		}
 
-		handleMessage(ln, conn)
+		receive(conn)
+	}
+
+	if Coordinator.Id() != -1 {
+		return
 	}
 
-	// determine the coordinator's identity
-	COORDINATOR = LastTimestamp.LowestIdAlive()
-	if COORDINATOR == ID {
+	// nobody knows the coordinator (e.g. the whole cluster is starting
+	// up), so the lowest operational id is the coordinator
+	if id := LastTimestamp.LowestIdAlive(); Coordinator.Adopt(id, 0) && id == ID {
 		// tell the master that this server is the coordinator
-		MessagesToMaster.Enqueue("coordinator " + strconv.Itoa(ID))
+		Masters.Notify("coordinator " + strconv.Itoa(ID))
 	}
 }
 
 // heartbeat sleeps for HEARTBEAT_INTERVAL and broadcasts an empty message to
 // every server to indicate that the server is still alive
+//
+// NOTE: heartbeats reuse the connections to other servers (see dialPeer)
 func heartbeat() {
 	for {
 		go broadcast(emptyMessage())
@@ -162,297 +323,320 @@ func heartbeat() {
 	}
 }
 
-// fetchMessages retrieves messages from other servers and adds them to the
-// log, listening on PORT (i.e. START_PORT + PORT)
+// fetchMessages retrieves messages from other servers and hands them to
+// handleMessage (see receive), listening on peerAddr(ID) (i.e. START_PORT + ID
+// by default)
 func fetchMessages(ln net.Listener) {
+	start := time.Now()
 	for {
-		lnr := (ln).(*net.TCPListener)
+		lnr := (ln).(*muxListener)
 		lnr.SetDeadline(time.Now().Add(TIMEOUT * time.Duration(NUM_PROCS)))
 		conn, err := lnr.Accept()
 
 		// elect a new coordinator if the coordinator has died
-		if COORDINATOR != -1 && COORDINATOR != ID && !LastTimestamp.IsAlive(COORDINATOR) {
+		//
+		// NOTE: a coordinator learned through gossip may not have
+		// reached this server yet, so give it ALIVE_INTERVAL to do so
+		coordinator := Coordinator.Id()
+		if coordinator != -1 && coordinator != ID && !LastTimestamp.IsAlive(coordinator) &&
+			time.Since(start) > ALIVE_INTERVAL {
 			initiateElectionProtocol()
 		}
 		if err != nil {
 			continue
 		}
 
-		handleMessage(ln, conn)
+		receive(conn)
 	}
 }
 
-// handleMessage retrieves the first message from conn, adds it to the log, and
-// closes the connection. It also updates LastTimestamp for the sending server.
-//
-// NOTE: This function must be called sequentially (NOT by starting a new
-// thread for each new connection) in order to maintain FIFO receipt.
-// Otherwise, depending on scheduling, a message B may be added to MessagesFIFO
-// before another message A, even though A connected first.
+// receive reads the first message from conn (a stream opened by another
+// server) in a new goroutine, updates LastTimestamp for the sender, and hands
+// the message to handleMessage
 //
-// The disadvantage is that, if the delivery of a message is blocked (e.g. the
-// sender died before it could terminate the message with a '\n'), then all of
-// the subsequent messages to be delivered are also blocked, possibly FOREVER.
-//
-// NOTE: If FIFO receipt is no longer necessary, we can simply sort
-// MessagesFIFO by send timestamp in order to approximate the send order. We
-// could also use a causal delivery method provided by a data structure such as
-// the vector.MessageReceptacle to deliver messages based on causal precedence.
-func handleMessage(ln net.Listener, conn net.Conn) {
-	defer conn.Close()
-
-	messenger := bufio.NewReader(conn)
-	conn.SetReadDeadline(time.Now().Add(TIMEOUT))
-	msgBytes, err := messenger.ReadBytes('\n')
-	if err != nil {
-		return
-	}
-
-	msg := new(Message)
-	err = json.Unmarshal(msgBytes, msg)
-	if err != nil {
+// Messages are read concurrently, so that a sender that stalls (e.g. because it
+// died before it could send the whole message) delays only its own messages.
+// Messages (i.e. chat messages and heartbeats) are handled in the order in
+// which the sender sent them over the connection (see Message.Seq and
+// tsInbox), while requests that belong to transactions (e.g. VoteReqs) are
+// handled as soon as they are read, since a participant may block in them
+// until the transaction is decided.
+func receive(conn net.Conn) {
+	stream, ok := conn.(*muxStream)
+	if !ok {
+		conn.Close()
 		return
 	}
+	sender := stream.session.peer
 
-	// update LastTimestamp for the sender
-	// NOTE: assumes message IDs are in {0..n-1}
-	LastTimestamp.UpdateTimestamp(msg)
-
-	if len(msg.Content) == 0 { // msg is an empty message
-		return
-	}
+	go func() {
+		conn.SetReadDeadline(time.Now().Add(TIMEOUT))
+		env, payload, err := readMessage(conn)
+		if err != nil {
+			conn.Close()
+			return
+		}
 
-	args := strings.Split(msg.Content, " ")
-	argLengthAtLeast := func(min int) bool {
-		if len(args) < min {
-			Error("not enough arguments to ",
-				args[0], " command: \"", msg.Content, "\"")
-			return false
+		// the sender must be the server at the other end of the
+		// connection (whose identity is verified if TLS is enabled)
+		if env.Id != sender {
+			Error("server ", sender, " sent a message as server ", env.Id)
+			conn.Close()
+			return
 		}
-		return true
-	}
 
-	switch args[0] {
-	case "get":
-		if argLengthAtLeast(2) {
-			getParticipant(conn, args[1])
+		// update LastTimestamp for the sender
+		// NOTE: assumes message IDs are in {0..n-1}
+		LastTimestamp.UpdateTimestamp(env.Id)
+		msg, ok := payload.(*Message)
+		if !ok {
+			handleMessage(conn, env, payload)
+			return
 		}
-	case "vote-req":
-		if argLengthAtLeast(3) {
-			if args[1] == "delete" {
-				deleteParticipant(ln, conn, args[2])
-			} else if argLengthAtLeast(4) && args[1] == "add" {
-				addParticipant(ln, conn, args[2], args[3])
-			} else {
-				Error("no such vote-req operation: \"",
-					strings.Join(args, " "), "\"")
-			}
+		if len(msg.Content) == 0 {
+			LastTimestamp.Heartbeat(env.Id, msg, env.Rts)
 		}
-	case "state-req":
-		if argLengthAtLeast(3) {
-			if args[1] == "delete" {
-				deleteTerminationProtocolParticipant(conn, args[2])
-			} else if argLengthAtLeast(4) && args[1] == "add" {
-				addTerminationProtocolParticipant(conn, args[2], args[3])
-			} else {
-				Error("no such state-req operation: \"",
-					strings.Join(args, " "), "\"")
+		stream.session.inbox.Deliver(msg.Seq, func() {
+			handleMessage(conn, env, payload)
+		})
+	}()
+}
+
+// handleMessage handles a message received from another server over conn
+// according to its type (e.g. adds it to the log), and closes the connection
+//
+// NOTE: the Messages of each sender are handled one at a time (see receive),
+// so handling them must not block (e.g. on another server). Other requests
+// (e.g. VoteReqs and Forwards) are each handled by their own goroutine, and may
+// block until their transaction is decided.
+func handleMessage(conn net.Conn, env *Envelope, payload Payload) {
+	defer conn.Close()
+
+	switch msg := payload.(type) {
+	case *Message:
+		switch {
+		case len(msg.Content) == 0: // msg is an empty message
+			gossip(msg)
+			if Ordering.Advertised(msg.Id, msg.Logged) {
+				catchUpLater(msg.Id)
+			}
+		case msg.Order != 0: // msg was numbered by the sequencer
+			if env.Id != Coordinator.Id() {
+				// e.g. a sequencer that doesn't know it was replaced
+				Metrics.Add("dropped_numbered", 1)
+				Error("dropped message ", msg.Order, " numbered by server ",
+					env.Id, ", which is not the sequencer")
+			} else if !Ordering.Receive(msg) {
+				catchUpLater(msg.Id)
+			}
+		case msg.Clock != nil: // msg was submitted to the sequencer
+			if Coordinator.Id() == ID {
+				enqueueSubmission(msg)
 			}
+		default:
+			Ordering.DeliverUnordered(msg)
+		}
+	case *LogReq:
+		writeMessage(conn, &LogResp{Messages: MessagesFIFO.Since(msg.From)})
+	case *Forward:
+		acceptForward(conn, msg)
+	case *Get:
+		getParticipant(conn, msg.Song)
+	case *VoteReq:
+		if msg.Op.Req != "" {
+			// a new coordinator may have to answer the request (see
+			// replayRequest)
+			writeToDtLog("request", msg.Op.Req, msg.Txn)
+		}
+		switch op := msg.Op; op.Kind {
+		case "config":
+			configParticipant(conn, msg.Txn, op.Config)
+		case "delete":
+			deleteParticipant(conn, msg.Txn, op.Song)
+		case "add":
+			addParticipant(conn, msg.Txn, op.Song, op.Url)
+		default:
+			Error("no such vote-req operation: \"", op, "\"")
+		}
+	case *Handoff:
+		acceptHandoff(conn, msg)
+	case *StateTransfer:
+		acceptStateTransfer(conn, msg)
+	case *StateReq:
+		switch op := msg.Op; op.Kind {
+		case "add", "delete", "config":
+			terminationProtocolParticipant(conn, msg.Txn, op)
+		default:
+			Error("no such state-req operation: \"", op, "\"")
 		}
 	default:
-		// TODO
+		Error("unexpected ", payload.Type(), " message from server ", env.Id)
 	}
-
-	// TODO: REMOVE
-	MessagesFIFO.Enqueue(msg)
 }
 
-// serveMaster listens on MASTER_PORT for a connection from a master process
-// and services its commands
+// gossip compares the view of the cluster carried by the heartbeat msg with
+// this server's own view
 //
-// NOTE: only one master process is served at any given time
-func serveMaster() {
-	// Bind the master-facing port and start listening for commands
-	ln, err := net.Listen("tcp", ":"+strconv.Itoa(MASTER_PORT))
-	if err != nil {
-		Fatal("failed to bind master-facing port: ",
-			strconv.Itoa(MASTER_PORT))
+// - a server that does not know the coordinator (e.g. it just recovered) or
+//   that is behind by one or more epochs adopts the sender's coordinator
+// - two servers that disagree about the coordinator of the same epoch both
+//   settle on the lower of the two ids (without starting a new epoch)
+// - a coordinator that learns about a transaction started in an earlier
+//   epoch (whose coordinator has since been replaced) runs the termination
+//   protocol for it in the background
+func gossip(msg *Message) {
+	if msg.Coordinator == -1 {
+		// the sender doesn't know the coordinator yet
+		return
 	}
 
-	for {
-		lnr := (ln).(*net.TCPListener)
-		lnr.SetDeadline(time.Now().Add(TIMEOUT * time.Duration(NUM_PROCS)))
-		masterConn, err := ln.Accept()
-		if err != nil {
-			continue
+	coordinator, epoch := Coordinator.Get()
+	switch {
+	case Coordinator.Adopt(msg.Coordinator, msg.Epoch):
+		if msg.Coordinator == ID && coordinator != ID {
+			// tell the master that this server is the coordinator
+			Masters.Notify("coordinator " + strconv.Itoa(ID))
 		}
-
-		handleMaster(masterConn)
-	}
-}
-
-// handleMaster executes commands from the master process and responds with any
-// requested data
-func handleMaster(masterConn net.Conn) {
-	defer masterConn.Close()
-	master := bufio.NewReader(bufio.NewReader(masterConn))
-
-	for {
-		// TODO: replace with direct writes to master connection in child
-		// calls
-		//
-		// send the next pending message to master
-		msg := MessagesToMaster.Dequeue()
-		if msg != "" {
-			masterConn.SetWriteDeadline(time.Now().Add(TIMEOUT))
-			if _, err := fmt.Fprintln(masterConn, msg); err != nil {
-				MessagesToMaster.PushFront(msg)
-			}
+	case Coordinator.Resolve(msg.Coordinator, msg.Epoch):
+		Error("server ", msg.Id, " believes ", msg.Coordinator,
+			" is the coordinator of epoch ", epoch, " (not ", coordinator,
+			"), deferring to it")
+		if msg.Coordinator == ID {
+			// tell the master that this server is the coordinator
+			Masters.Notify("coordinator " + strconv.Itoa(ID))
 		}
+	}
 
-		// check for a new command from master
-		masterConn.SetReadDeadline(time.Now().Add(TIMEOUT))
-		command, err := master.ReadString('\n')
-		if err != nil {
-			netErr, ok := err.(net.Error)
-			if ok && netErr.Timeout() {
-				continue
-			}
-			// connection to master lost
-			return
+	coordinator, epoch = Coordinator.Get()
+	if coordinator != ID {
+		return
+	}
+	for txn, operation := range msg.InFlight {
+		// InFlight keeps later heartbeats from terminating txn again while
+		// this runs (which would otherwise hold up the read goroutine)
+		if txnEpoch(txn) >= epoch || !InFlight.TryAdd(txn, operation) {
+			continue
 		}
-
-		command = strings.TrimSpace(command)
-		execute(masterConn, command)
+		go func(txn string, operation Operation) {
+			defer InFlight.Remove(txn)
+			terminateTransaction(msg.Up, txn, operation)
+		}(txn, operation)
 	}
 }
 
-// TODO: Delete?
-func writeMessages(rwr *bufio.ReadWriter) {
-	rwr.WriteString("messages ")
-	MessagesFIFO.WriteMessages(rwr)
-	rwr.WriteByte('\n')
-
-	err := rwr.Flush()
-	if err != nil {
-		Fatal(err)
-	}
+// writeMessages responds to the "messages" command with the log of chat
+// messages
+func writeMessages(s *masterSession) {
+	var buf bytes.Buffer
+	buf.WriteString("messages ")
+	MessagesFIFO.WriteMessages(&buf)
+	buf.WriteByte('\n')
+	s.Write(buf.Bytes())
 }
 
-// TODO: Delete?
-func writeAlive(rwr *bufio.ReadWriter) {
+// writeAlive responds to the "alive" command with the ids of the servers that
+// are believed to be alive (and their suspicion levels if suspicion is true)
+func writeAlive(s *masterSession, suspicion bool) {
 	now := time.Now()
 
-	rwr.WriteString("alive ")
-	LastTimestamp.WriteAlive(rwr, now)
-	rwr.WriteByte('\n')
-
-	err := rwr.Flush()
-	if err != nil {
-		Fatal(err)
-	}
+	var buf bytes.Buffer
+	buf.WriteString("alive ")
+	LastTimestamp.WriteAlive(&buf, now, suspicion)
+	buf.WriteByte('\n')
+	s.Write(buf.Bytes())
 }
 
 // broadcast sends the given message to all other servers (including itself and
-// excluding the master)
+// excluding the master), i.e. to the members of the cluster and to any live
+// server waiting to join it
 //
 // NOTE: Sends are sequential, so that broadcast does not return until an
 // attempt has been made to send the message to all servers
 //
-// NOTE: This function must be called sequentially (NOT by starting a new
-// thread for each new message) in order to maintain FIFO receipt. Otherwise,
-// depending on scheduling, a message B could be broadcast to a server before
-// another message A, even though A's thread was started first.
+// Non-empty messages are submitted to the sequencer instead, which delivers
+// them to every server in the same order (see order.go), unless the sequencer
+// doesn't support it.
 //
-// The disadvantage is that, if the receipt of one message is delayed for any
-// of its recipients, then all of the subsequent commands sent by the master
-// are also delayed (until the send times out). This may cause servers to not
-// receive the message on time. This is likely not an issue when working with a
-// small number of servers.
-//
-// NOTE: If FIFO receipt is no longer necessary, the recipient can simply sort
-// delivered messages by send timestamp in order to approximate the send order.
-// They could also use a causal delivery method provided by a data structure
-// such as the vector.MessageReceptacle to deliver messages based on causal
-// precedence.
+// NOTE: Non-empty messages are broadcast one at a time (see BroadcastMutex), so
+// that they are submitted in the order in which they were stamped with their
+// vector clocks, which causal delivery relies on (see causal.go).
 func broadcast(msg *Message) {
-	// Convert to JSON
-	msgBytes, err := json.Marshal(msg)
-	if err != nil {
-		return
-	}
-	msgJSON := string(msgBytes)
-
-	// send non-empty messages to self
 	if len(msg.Content) != 0 {
-		MessagesFIFO.Enqueue(msg)
+		BroadcastMutex.Lock()
+		defer BroadcastMutex.Unlock()
+
+		if coordinator := Coordinator.Id(); coordinator == ID || coordinator == -1 ||
+			peerSupports(coordinator, "total-order") {
+			Causal.Stamp(msg)
+			Ordering.Submit(msg)
+			submit(msg)
+			return
+		}
+
+		// send non-empty messages to self
+		Ordering.DeliverUnordered(msg)
 	}
 
 	// send message to other servers
-	for id := 0; id < NUM_PROCS; id++ {
+	ids := append(Members.Ids(), LastTimestamp.GetAliveNonMembers(time.Now())...)
+	for _, id := range ids {
 		if id == ID {
 			continue
 		}
 
-		sendMarshaled(msgJSON, id)
+		sendMessage(msg, id)
 	}
 }
 
-// send a message to the server with the given id
-func sendMarshaled(msg string, id int) error {
-	// TODO: In the future, you may want to consider using
-	// net.DialTimeout (e.g. the recipient is so busy it cannot
-	// service the send in a reasonable amount of time) and/or
-	// consider starting a new thread for every send to prevent
-	// sends from blocking each other (the timeout might help
-	// prevent a buildup of threads that can't progress)
-	conn, err := net.Dial("tcp", ":"+strconv.Itoa(START_PORT+id))
+// send a message to the server with the given id (over a new stream on the
+// connection to that server, see dialPeer)
+//
+// Messages are numbered by the connection (see Message.Seq), so msg is copied
+// rather than modified.
+func sendMessage(msg Payload, id int) error {
+	conn, err := dialPeer(id)
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
 
+	if m, ok := msg.(*Message); ok {
+		numbered := *m
+		numbered.Seq = conn.(*muxStream).session.nextMessageSeq()
+		msg = &numbered
+	}
+
 	conn.SetWriteDeadline(time.Now().Add(TIMEOUT))
-	_, err = fmt.Fprintln(conn, msg)
-	return err
+	return writeMessage(conn, msg)
 }
 
-// sendAndWaitForResponse takes a Message marshaled into JSON and tries to send
-// it to the server with the given id. Returns the response with any leading or
-// trailing whitespace removed.
+// sendAndWaitForResponse tries to send the given message to the server with
+// the given id and returns its response
 //
 // Returns an error whose value is "timeout" if the recipient fails to respond
 // within a period of TIMEOUT.
-//
-// Returns an error whose value is "empty response" if the recipient sends an
-// empty response.
-func sendAndWaitForResponse(msg string, id int) ([]byte, error) {
-	conn, err := net.Dial("tcp", ":"+strconv.Itoa(START_PORT+id))
+func sendAndWaitForResponse(msg Payload, id int) (Payload, error) {
+	conn, err := dialPeer(id)
 	if err != nil {
 		return nil, err
 	}
 	defer conn.Close()
 
 	conn.SetWriteDeadline(time.Now().Add(TIMEOUT))
-	_, err = fmt.Fprintln(conn, msg)
+	err = writeMessage(conn, msg)
 	if err != nil {
 		return nil, err
 	}
 
-	r := bufio.NewReader(conn)
 	conn.SetReadDeadline(time.Now().Add(TIMEOUT))
-	resp, err := r.ReadBytes('\n')
+	_, resp, err := readMessage(conn)
 	if err != nil {
-		if netErr := err.(net.Error); netErr.Timeout() {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 			// TODO: Update UP set?
 			return nil, errors.New("timeout")
 		}
 		return nil, err
 	}
 
-	if resp == nil {
-		return nil, errors.New("empty response")
-	}
-
-	return bytes.TrimSpace(resp), nil
+	return resp, nil
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"time"
+)
+
+// Servers can authenticate each other with mutual TLS (see the -tls flag).
+// Every server then needs the following files in the TLS directory, which can
+// be generated with "gencerts":
+//
+//  ca.pem                  certificate of the cluster's certificate authority
+//  server-<id>.pem         the server's certificate (signed by the CA)
+//  server-<id>-key.pem     the server's private key
+//
+// The certificate of the server with a given id is issued to the name
+// "server-<id>" (see certName). A server only accepts connections from servers
+// whose certificate matches the id they claim in their frameHello, and only
+// talks to servers whose certificate matches the id it dialed.
+
+var TLS_CONFIG *tls.Config // nil unless TLS_DIR is set (see loadTLS)
+
+// certName returns the name the certificate of the server with the given id is
+// issued to
+func certName(id int) string {
+	return fmt.Sprintf("server-%d", id)
+}
+
+// loadTLS reads the CA certificate and this server's certificate and key from
+// the given directory
+func loadTLS(dir string) error {
+	caPEM, err := ioutil.ReadFile(filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		return err
+	}
+	ca := x509.NewCertPool()
+	if !ca.AppendCertsFromPEM(caPEM) {
+		return errors.New(filepath.Join(dir, "ca.pem") + ": no certificates found")
+	}
+
+	cert, err := tls.LoadX509KeyPair(
+		filepath.Join(dir, certName(ID)+".pem"),
+		filepath.Join(dir, certName(ID)+"-key.pem"))
+	if err != nil {
+		return err
+	}
+
+	TLS_CONFIG = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      ca,
+		ClientCAs:    ca,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+	return nil
+}
+
+// tlsClient runs a TLS handshake over conn (a new connection to the server with
+// the given id), verifying that the other end is that server
+func tlsClient(conn net.Conn, id int) (net.Conn, error) {
+	config := TLS_CONFIG.Clone()
+	config.ServerName = certName(id)
+
+	tc := tls.Client(conn, config)
+	tc.SetDeadline(time.Now().Add(HEARTBEAT_INTERVAL))
+	defer tc.SetDeadline(time.Time{})
+	if err := tc.Handshake(); err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
+
+// tlsServer runs a TLS handshake over conn (a connection accepted from another
+// server), which requires the other end to present a certificate signed by the
+// cluster CA
+func tlsServer(conn net.Conn) (net.Conn, error) {
+	tc := tls.Server(conn, TLS_CONFIG)
+	tc.SetDeadline(time.Now().Add(ALIVE_INTERVAL))
+	defer tc.SetDeadline(time.Time{})
+	if err := tc.Handshake(); err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
+
+// verifyPeerId returns an error unless conn is a plain connection (i.e. TLS is
+// disabled) or the certificate presented by the other end of conn was issued
+// to the server with the given id
+func verifyPeerId(conn net.Conn, id int) error {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return errors.New("no certificate")
+	}
+	if err := certs[0].VerifyHostname(certName(id)); err != nil {
+		return fmt.Errorf("certificate does not belong to server %d: %v", id, err)
+	}
+	return nil
+}
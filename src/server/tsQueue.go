@@ -1,10 +1,16 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"protocol"
 )
 
 type tsMsgQueue struct {
@@ -18,6 +24,25 @@ func (tsq *tsMsgQueue) Enqueue(msg *Message) {
 	tsq.mutex.Unlock()
 }
 
+// Len returns the number of messages in the queue
+func (tsq *tsMsgQueue) Len() uint64 {
+	tsq.mutex.Lock()
+	defer tsq.mutex.Unlock()
+	return uint64(len(tsq.value))
+}
+
+// Since returns the messages in the queue starting from the given position
+// (the first message is at position 1)
+func (tsq *tsMsgQueue) Since(from uint64) []*Message {
+	tsq.mutex.Lock()
+	defer tsq.mutex.Unlock()
+
+	if from == 0 || from > uint64(len(tsq.value)) {
+		return nil
+	}
+	return append([]*Message(nil), tsq.value[from-1:]...)
+}
+
 func (tsq *tsMsgQueue) Dequeue() *Message {
 	tsq.mutex.Lock()
 	var v *Message
@@ -29,110 +54,352 @@ func (tsq *tsMsgQueue) Dequeue() *Message {
 	return v
 }
 
-func (tsq *tsMsgQueue) WriteMessages(rwr *bufio.ReadWriter) {
+func (tsq *tsMsgQueue) WriteMessages(buf *bytes.Buffer) {
 	tsq.mutex.Lock()
 	if len(tsq.value) > 0 {
 		msgs := tsq.value
 		lst := len(msgs) - 1
 		for _, msg := range msgs[:lst] {
-			rwr.WriteString(msg.Content)
-			rwr.WriteByte(',')
+			buf.WriteString(msg.Content)
+			buf.WriteByte(',')
 		}
-		rwr.WriteString(msgs[lst].Content)
+		buf.WriteString(msgs[lst].Content)
 	}
 	tsq.mutex.Unlock()
 }
 
+// tsTimestampQueue keeps track of when the last message from each server
+// arrived (by this server's monotonic clock) along with the history of its
+// heartbeats and the offset of its clock
 type tsTimestampQueue struct {
-	value []time.Time
-	mutex sync.Mutex // mutex for accessing contents
+	value      map[int]time.Time         // keyed by server id
+	heartbeats map[int]*heartbeatHistory // keyed by server id (see detector.go)
+	echoes     map[int]echo              // last heartbeat from each server (see clock.go)
+	clocks     map[int]*clockEstimator   // keyed by server id (see clock.go)
+	mutex      sync.Mutex                // mutex for accessing contents
+}
+
+// UpdateTimestamp records the arrival of a message from the server with the
+// given id
+func (tsq *tsTimestampQueue) UpdateTimestamp(id int) {
+	tsq.mutex.Lock()
+	if tsq.value == nil {
+		tsq.value = make(map[int]time.Time)
+	}
+	tsq.value[id] = time.Now()
+	tsq.mutex.Unlock()
+}
+
+// Heartbeat records the arrival of a heartbeat from the server with the given
+// id (see detector.go), which it sent at the given time, and updates the
+// estimate of the offset of its clock (see clock.go)
+func (tsq *tsTimestampQueue) Heartbeat(id int, msg *Message, sent time.Time) {
+	tsq.mutex.Lock()
+	defer tsq.mutex.Unlock()
+
+	if tsq.heartbeats == nil {
+		tsq.heartbeats = make(map[int]*heartbeatHistory)
+		tsq.echoes = make(map[int]echo)
+		tsq.clocks = make(map[int]*clockEstimator)
+	}
+	h, ok := tsq.heartbeats[id]
+	if !ok {
+		h = new(heartbeatHistory)
+		tsq.heartbeats[id] = h
+		tsq.clocks[id] = new(clockEstimator)
+	}
+
+	now := time.Now()
+	if !h.record(msg.Beat, now) {
+		return
+	}
+	tsq.echoes[id] = echo{Sent: sent, Received: now.Round(0)}
+
+	if e, ok := msg.Echo[ID]; ok {
+		tsq.clocks[id].add(&e, sent, now)
+		tsq.clocks[id].checkSkew(id)
+	}
 }
 
-// NOTE: assumes message IDs are in {0..n-1}
-func (tsq *tsTimestampQueue) UpdateTimestamp(msg *Message) {
-	LastTimestamp.mutex.Lock()
-	LastTimestamp.value[msg.Id] = msg.Rts
-	LastTimestamp.mutex.Unlock()
+// Echoes returns the send and arrival times of the last heartbeat from each
+// server (see Message.Echo)
+func (tsq *tsTimestampQueue) Echoes() map[int]echo {
+	tsq.mutex.Lock()
+	defer tsq.mutex.Unlock()
+
+	echoes := make(map[int]echo, len(tsq.echoes))
+	for id, e := range tsq.echoes {
+		echoes[id] = e
+	}
+	return echoes
 }
 
-func (tsq *tsTimestampQueue) WriteAlive(rwr *bufio.ReadWriter, now time.Time) {
-	LastTimestamp.mutex.Lock()
-	stmps := LastTimestamp.value
-	for id := 0; id < ID; id++ {
-		// add all server ids for which a
-		// heartbeat was sent within the
-		// alive interval
-		if now.Sub(stmps[id]) < ALIVE_INTERVAL {
-			rwr.WriteString(strconv.Itoa(id))
-			rwr.WriteByte(',')
+// Clocks returns the estimated offset of every other server's clock and the
+// round trip of the estimate in the form "<id>=<offset>/<round trip>,..."
+// (sorted by id)
+func (tsq *tsTimestampQueue) Clocks() string {
+	tsq.mutex.Lock()
+	defer tsq.mutex.Unlock()
+
+	ids := make([]int, 0, len(tsq.clocks))
+	for id := range tsq.clocks {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	var clocks []string
+	for _, id := range ids {
+		if s, ok := tsq.clocks[id].estimate(); ok {
+			clocks = append(clocks, fmt.Sprintf("%d=%s/%.3fms", id,
+				formatOffset(s.offset), millis(s.roundTrip)))
 		}
 	}
-	rwr.WriteString(strconv.Itoa(ID))
-	for id := ID + 1; id < NUM_PROCS; id++ {
-		// add all server ids for which a
-		// heartbeat was sent within the
-		// heartbeat interval
-		if now.Sub(stmps[id]) < HEARTBEAT_INTERVAL {
-			rwr.WriteByte(',')
-			rwr.WriteString(strconv.Itoa(id))
+	return strings.Join(clocks, ",")
+}
+
+// isAlive returns true if the server with the given id (member or not) is
+// believed to be alive at the given time, i.e. if its phi is below
+// PHI_THRESHOLD (or, if PHI_THRESHOLD is 0, if a message from it arrived within
+// the alive interval)
+//
+// NOTE: tsq.mutex must be held
+func (tsq *tsTimestampQueue) isAlive(id int, now time.Time) bool {
+	if PHI_THRESHOLD == 0 {
+		stmp, ok := tsq.value[id]
+		return ok && now.Sub(stmp) < ALIVE_INTERVAL
+	}
+	h, ok := tsq.heartbeats[id]
+	return ok && h.phi(now) < PHI_THRESHOLD
+}
+
+// phi returns the level of suspicion that the server with the given id failed
+// (0 for this server and +Inf for servers that never sent a heartbeat)
+//
+// NOTE: tsq.mutex must be held
+func (tsq *tsTimestampQueue) phi(id int, now time.Time) float64 {
+	if id == ID {
+		return 0
+	} else if h, ok := tsq.heartbeats[id]; ok {
+		return h.phi(now)
+	}
+	return math.Inf(1)
+}
+
+// WriteAlive writes the ids of the servers that are alive (see GetAlive), each
+// followed by its suspicion level (e.g. "1:0.42") if suspicion is true
+func (tsq *tsTimestampQueue) WriteAlive(buf *bytes.Buffer, now time.Time, suspicion bool) {
+	alive := tsq.GetAlive(now)
+
+	tsq.mutex.Lock()
+	defer tsq.mutex.Unlock()
+	for i, id := range alive {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(strconv.Itoa(id))
+		if suspicion {
+			buf.WriteByte(':')
+			buf.WriteString(formatPhi(tsq.phi(id, now)))
 		}
 	}
-	LastTimestamp.mutex.Unlock()
 }
 
+// Suspicions returns the suspicion level of every other server that has sent
+// a heartbeat, dead or alive, in the form "<id>=<phi>,..." (sorted by id)
+func (tsq *tsTimestampQueue) Suspicions(now time.Time) string {
+	tsq.mutex.Lock()
+	defer tsq.mutex.Unlock()
+
+	ids := make([]int, 0, len(tsq.heartbeats))
+	for id := range tsq.heartbeats {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	suspicions := make([]string, len(ids))
+	for i, id := range ids {
+		suspicions[i] = strconv.Itoa(id) + "=" + formatPhi(tsq.phi(id, now))
+	}
+	return strings.Join(suspicions, ",")
+}
+
+// GetAlive returns the ids of all members of the cluster (including this
+// server) that are believed to be alive
 func (tsq *tsTimestampQueue) GetAlive(now time.Time) []int {
 	var alive []int
 
-	LastTimestamp.mutex.Lock()
-	stmps := LastTimestamp.value
-	for id := 0; id < ID; id++ {
-		// add all server ids for which a
-		// heartbeat was sent within the
-		// alive interval
-		if now.Sub(stmps[id]) < ALIVE_INTERVAL {
+	// NOTE: Members is read before locking, so that this never holds both
+	// mutexes at once
+	ids := Members.Ids()
+	tsq.mutex.Lock()
+	for _, id := range ids {
+		if id == ID || tsq.isAlive(id, now) {
 			alive = append(alive, id)
 		}
 	}
-	alive = append(alive, ID)
-	for id := ID + 1; id < NUM_PROCS; id++ {
-		// add all server ids for which a
-		// heartbeat was sent within the
-		// alive interval
-		if now.Sub(stmps[id]) < ALIVE_INTERVAL {
+	tsq.mutex.Unlock()
+
+	return alive
+}
+
+// GetAliveNonMembers returns the ids of all servers outside of the cluster
+// (e.g. servers waiting to join) that are believed to be alive
+func (tsq *tsTimestampQueue) GetAliveNonMembers(now time.Time) []int {
+	var alive []int
+
+	// NOTE: Members is read before locking (see GetAlive)
+	members := make(map[int]bool)
+	for _, id := range Members.Ids() {
+		members[id] = true
+	}
+	tsq.mutex.Lock()
+	for id := range tsq.value {
+		if !members[id] && tsq.isAlive(id, now) {
 			alive = append(alive, id)
 		}
 	}
-	LastTimestamp.mutex.Unlock()
+	tsq.mutex.Unlock()
 
 	return alive
 }
 
 func (tsq *tsTimestampQueue) LowestIdAlive() int {
-	now := time.Now()
-
-	LastTimestamp.mutex.Lock()
-	stmps := LastTimestamp.value
-	for id := 0; id < ID; id++ {
-		// add all server ids for which a
-		// heartbeat was sent within the
-		// alive interval
-		if now.Sub(stmps[id]) < ALIVE_INTERVAL {
-			return id
-		}
+	if alive := tsq.GetAlive(time.Now()); len(alive) > 0 && alive[0] < ID {
+		return alive[0]
 	}
-	LastTimestamp.mutex.Unlock()
-
 	return ID
 }
 
+// MarkDead makes the server with the given id look dead until its next
+// heartbeat (e.g. because the connection to it was lost)
+func (tsq *tsTimestampQueue) MarkDead(id int) {
+	tsq.mutex.Lock()
+	if _, ok := tsq.value[id]; ok {
+		tsq.value[id] = time.Time{}
+	}
+	if h, ok := tsq.heartbeats[id]; ok {
+		h.last = time.Time{}
+	}
+	tsq.mutex.Unlock()
+}
+
+// IsAlive returns true if the server with the given id (member or not) is
+// believed to be alive
 func (tsq *tsTimestampQueue) IsAlive(id int) bool {
-	LastTimestamp.mutex.Lock()
-	if time.Now().Sub(LastTimestamp.value[id]) < ALIVE_INTERVAL {
-		LastTimestamp.mutex.Unlock()
-		return true
+	tsq.mutex.Lock()
+	defer tsq.mutex.Unlock()
+	return tsq.isAlive(id, time.Now())
+}
+
+// tsMembers is the (sorted) list of ids of the servers in the cluster
+type tsMembers struct {
+	value []int
+	mutex sync.Mutex // mutex for accessing contents
+}
+
+// Set replaces the members of the cluster with the given ids and updates
+// NUM_PROCS accordingly
+func (tsm *tsMembers) Set(ids []int) {
+	ids = append([]int(nil), ids...)
+	sort.Ints(ids)
+
+	tsm.mutex.Lock()
+	tsm.value = ids
+	NUM_PROCS = len(ids)
+	tsm.mutex.Unlock()
+}
+
+func (tsm *tsMembers) Ids() []int {
+	tsm.mutex.Lock()
+	ids := append([]int(nil), tsm.value...)
+	tsm.mutex.Unlock()
+	return ids
+}
+
+func (tsm *tsMembers) Contains(id int) bool {
+	tsm.mutex.Lock()
+	defer tsm.mutex.Unlock()
+	i := sort.SearchInts(tsm.value, id)
+	return i < len(tsm.value) && tsm.value[i] == id
+}
+
+// String returns the members as a comma-separated list of ids (e.g. "0,1,2")
+func (tsm *tsMembers) String() string {
+	return protocol.FormatIds(tsm.Ids())
+}
+
+// tsCoordinator is the id of the server this server believes is the
+// coordinator, along with the epoch in which it was chosen (-1 and 0 until the
+// coordinator is known)
+//
+// The coordinator only changes along with the epoch, by compare-and-set on the
+// epoch (see Adopt and CompareAndSet), so that concurrent changes (e.g. a
+// heartbeat from a new coordinator during an election) never leave a
+// coordinator paired with the wrong epoch.
+type tsCoordinator struct {
+	id    int
+	epoch int
+	mutex sync.Mutex // mutex for accessing contents
+}
+
+// Get returns the id of the coordinator and its epoch
+func (tsc *tsCoordinator) Get() (int, int) {
+	tsc.mutex.Lock()
+	defer tsc.mutex.Unlock()
+	return tsc.id, tsc.epoch
+}
+
+func (tsc *tsCoordinator) Id() int {
+	id, _ := tsc.Get()
+	return id
+}
+
+func (tsc *tsCoordinator) Epoch() int {
+	_, epoch := tsc.Get()
+	return epoch
+}
+
+// Adopt makes id the coordinator of the given epoch if the coordinator is not
+// known yet or epoch is later than the current one, and returns true if it did
+func (tsc *tsCoordinator) Adopt(id, epoch int) bool {
+	tsc.mutex.Lock()
+	defer tsc.mutex.Unlock()
+
+	if tsc.id != -1 && epoch <= tsc.epoch {
+		return false
+	}
+	tsc.id, tsc.epoch = id, epoch
+	return true
+}
+
+// Resolve settles a disagreement about the coordinator of the given epoch in
+// favour of the lower id: it makes id the coordinator if epoch is the current
+// one and id is lower than the current coordinator, and returns true if it did
+//
+// NOTE: the epoch stays the same, so that every server involved ends up with
+// the same coordinator without a round of elections.
+func (tsc *tsCoordinator) Resolve(id, epoch int) bool {
+	tsc.mutex.Lock()
+	defer tsc.mutex.Unlock()
+
+	if epoch != tsc.epoch || id >= tsc.id {
+		return false
+	}
+	tsc.id = id
+	return true
+}
+
+// CompareAndSet makes id the coordinator of newEpoch if the current epoch is
+// still epoch, and returns true if it did
+func (tsc *tsCoordinator) CompareAndSet(epoch, id, newEpoch int) bool {
+	tsc.mutex.Lock()
+	defer tsc.mutex.Unlock()
+
+	if tsc.epoch != epoch {
+		return false
 	}
-	LastTimestamp.mutex.Unlock()
-	return false
+	tsc.id, tsc.epoch = id, newEpoch
+	return true
 }
 
 type tsStringQueue struct {
@@ -162,3 +429,234 @@ func (tsq *tsStringQueue) Dequeue() string {
 	tsq.mutex.Unlock()
 	return v
 }
+
+// tsTxnMap is a set of transactions (keyed by transaction id) along with the
+// operation each transaction performs
+type tsTxnMap struct {
+	value map[string]Operation
+	mutex sync.Mutex // mutex for accessing contents
+}
+
+func (tsm *tsTxnMap) Add(txn string, operation Operation) {
+	tsm.mutex.Lock()
+	if tsm.value == nil {
+		tsm.value = make(map[string]Operation)
+	}
+	tsm.value[txn] = operation
+	tsm.mutex.Unlock()
+}
+
+// TryAdd adds txn unless it is already present, and returns true if it did
+func (tsm *tsTxnMap) TryAdd(txn string, operation Operation) bool {
+	tsm.mutex.Lock()
+	defer tsm.mutex.Unlock()
+	if _, ok := tsm.value[txn]; ok {
+		return false
+	}
+	if tsm.value == nil {
+		tsm.value = make(map[string]Operation)
+	}
+	tsm.value[txn] = operation
+	return true
+}
+
+func (tsm *tsTxnMap) Remove(txn string) {
+	tsm.mutex.Lock()
+	delete(tsm.value, txn)
+	tsm.mutex.Unlock()
+}
+
+func (tsm *tsTxnMap) Has(txn string) bool {
+	tsm.mutex.Lock()
+	_, ok := tsm.value[txn]
+	tsm.mutex.Unlock()
+	return ok
+}
+
+// Copy returns a copy of the contents (or nil if there are none)
+func (tsm *tsTxnMap) Copy() map[string]Operation {
+	tsm.mutex.Lock()
+	defer tsm.mutex.Unlock()
+	if len(tsm.value) == 0 {
+		return nil
+	}
+	c := make(map[string]Operation, len(tsm.value))
+	for txn, operation := range tsm.value {
+		c[txn] = operation
+	}
+	return c
+}
+
+// tsIdSet is a set of server ids
+type tsIdSet struct {
+	value map[int]bool
+	mutex sync.Mutex // mutex for accessing contents
+}
+
+// TryAdd adds id unless it is already present, and returns true if it did
+func (tss *tsIdSet) TryAdd(id int) bool {
+	tss.mutex.Lock()
+	defer tss.mutex.Unlock()
+	if tss.value[id] {
+		return false
+	}
+	if tss.value == nil {
+		tss.value = make(map[int]bool)
+	}
+	tss.value[id] = true
+	return true
+}
+
+func (tss *tsIdSet) Remove(id int) {
+	tss.mutex.Lock()
+	delete(tss.value, id)
+	tss.mutex.Unlock()
+}
+
+// tsCounters is a set of named counters (see Metrics)
+type tsCounters struct {
+	value map[string]int64
+	mutex sync.Mutex // mutex for accessing contents
+}
+
+func (tsc *tsCounters) Add(name string, delta int64) {
+	tsc.mutex.Lock()
+	if tsc.value == nil {
+		tsc.value = make(map[string]int64)
+	}
+	tsc.value[name] += delta
+	tsc.mutex.Unlock()
+}
+
+// String returns the counters in the form "<name>=<value>,..." (sorted by
+// name)
+func (tsc *tsCounters) String() string {
+	tsc.mutex.Lock()
+	defer tsc.mutex.Unlock()
+
+	names := make([]string, 0, len(tsc.value))
+	for name := range tsc.value {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	counters := make([]string, len(names))
+	for i, name := range names {
+		counters[i] = name + "=" + strconv.FormatInt(tsc.value[name], 10)
+	}
+	return strings.Join(counters, ",")
+}
+
+// tsInbox hands the messages received over a connection from another server to
+// their handlers in the order given by their sequence numbers (see
+// Message.Seq), even if they are read (i.e. arrive) out of order (see receive)
+//
+// A message that never arrives (e.g. because the sender died before it could
+// send all of it) holds up the following ones for at most TIMEOUT, after which
+// it is skipped. If it does arrive after all, it is dropped, since handling it
+// then would break the order of the messages.
+type tsInbox struct {
+	next    uint64            // sequence number of the next message to handle
+	pending map[uint64]func() // messages (i.e. their handlers) by sequence number
+	running bool              // true while a goroutine is handling messages
+	timer   *time.Timer       // skips the next message if it doesn't arrive
+	mutex   sync.Mutex        // mutex for accessing contents
+}
+
+// Deliver hands the message with the given sequence number to handle, which is
+// called once all of the previous messages have been handled (or skipped).
+// Messages that are not numbered (i.e. seq is 0) are handled right away, and
+// messages that were skipped are dropped (and counted in Metrics).
+//
+// Messages are handled one at a time by a single goroutine.
+func (tsi *tsInbox) Deliver(seq uint64, handle func()) {
+	tsi.mutex.Lock()
+	if tsi.next == 0 {
+		tsi.next = 1
+		tsi.pending = make(map[uint64]func())
+	}
+	if seq == 0 {
+		tsi.mutex.Unlock()
+		handle()
+		return
+	} else if seq < tsi.next {
+		tsi.mutex.Unlock()
+		Metrics.Add("late_messages", 1)
+		Error("dropped message ", seq, ", which arrived after it was skipped")
+		return
+	}
+	tsi.pending[seq] = handle
+	tsi.release()
+	tsi.mutex.Unlock()
+}
+
+// release starts handling messages if the next one arrived, and otherwise
+// starts the timer that skips it if later ones are waiting for it
+//
+// NOTE: must be called with the mutex held
+func (tsi *tsInbox) release() {
+	if tsi.running {
+		return
+	}
+	if _, ok := tsi.pending[tsi.next]; ok {
+		if tsi.timer != nil {
+			tsi.timer.Stop()
+			tsi.timer = nil
+		}
+		tsi.running = true
+		go tsi.handle()
+	} else if len(tsi.pending) > 0 && tsi.timer == nil {
+		// NOTE: timer is read with the mutex held, since it is only
+		// set once the timer has started
+		var timer *time.Timer
+		timer = time.AfterFunc(TIMEOUT, func() {
+			tsi.mutex.Lock()
+			defer tsi.mutex.Unlock()
+			tsi.skip(timer)
+		})
+		tsi.timer = timer
+	}
+}
+
+// handle calls the handlers of the messages that are next in order
+func (tsi *tsInbox) handle() {
+	for {
+		tsi.mutex.Lock()
+		handle, ok := tsi.pending[tsi.next]
+		if !ok {
+			tsi.running = false
+			tsi.release()
+			tsi.mutex.Unlock()
+			return
+		}
+		delete(tsi.pending, tsi.next)
+		tsi.next++
+		tsi.mutex.Unlock()
+
+		handle()
+	}
+}
+
+// skip gives up on the missing messages before the first one waiting, unless
+// timer was stopped in the meantime
+//
+// NOTE: must be called with the mutex held
+func (tsi *tsInbox) skip(timer *time.Timer) {
+	if tsi.timer != timer {
+		return
+	}
+	tsi.timer = nil
+	if tsi.running || len(tsi.pending) == 0 {
+		return
+	}
+
+	first := uint64(0)
+	for seq := range tsi.pending {
+		if first == 0 || seq < first {
+			first = seq
+		}
+	}
+	Metrics.Add("skipped_messages", int64(first-tsi.next))
+	tsi.next = first
+	tsi.release()
+}
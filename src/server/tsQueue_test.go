@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInboxOrder(t *testing.T) {
+	var inbox tsInbox
+	handled := make(chan uint64, 3)
+	for _, seq := range []uint64{2, 3, 1} {
+		seq := seq
+		inbox.Deliver(seq, func() { handled <- seq })
+	}
+
+	for want := uint64(1); want <= 3; want++ {
+		if seq := <-handled; seq != want {
+			t.Fatalf("handled message %d, want %d", seq, want)
+		}
+	}
+}
+
+func TestInboxDropsSkippedMessage(t *testing.T) {
+	var inbox tsInbox
+	handled := make(chan uint64, 2)
+	late := func() int64 {
+		Metrics.mutex.Lock()
+		defer Metrics.mutex.Unlock()
+		return Metrics.value["late_messages"]
+	}
+	before := late()
+
+	// message 1 is skipped after TIMEOUT
+	inbox.Deliver(2, func() { handled <- 2 })
+	if seq := <-handled; seq != 2 {
+		t.Fatalf("handled message %d, want 2", seq)
+	}
+
+	inbox.Deliver(1, func() { handled <- 1 })
+	select {
+	case seq := <-handled:
+		t.Errorf("handled message %d after it was skipped", seq)
+	case <-time.After(10 * TIMEOUT):
+	}
+	if n := late() - before; n != 1 {
+		t.Errorf("late_messages increased by %d, want 1", n)
+	}
+}
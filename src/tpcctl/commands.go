@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"client"
+	"protocol"
+)
+
+// command is a command of the shell
+type command struct {
+	usage string
+	help  string
+	min   int // minimum number of arguments
+	run   func(sh *shell, args []string) bool
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"add":    {"add <song> <url>", "add a song (or update its url)", 2, (*shell).add},
+		"delete": {"delete <song>", "delete a song", 1, (*shell).delete},
+		"get":    {"get <song>", "print the url of a song", 1, (*shell).get},
+		"status": {"status", "print the state of every server", 0, (*shell).status},
+		"alive": {"alive [id]", "print the servers a server (or every server) believes to be alive",
+			0, (*shell).alive},
+		"crash": {"crash <id>", "crash a server", 1, (*shell).crash},
+		"failpoint": {"failpoint <id|all> <point> [ids]",
+			"set a crash point (partial ones take the servers reached before the crash, e.g. \"failpoint 0 partialCommit 1\")",
+			2, (*shell).failpoint},
+		"dump": {"dump [id]", "print the messages, counters and clocks of a server (or every server)",
+			0, (*shell).dump},
+		"help": {"help", "print this list", 0, (*shell).help},
+	}
+}
+
+// failpoints are the crash points that can be set with "failpoint" (see
+// setCrashPoint in src/server)
+var failpoints = []string{"crashAfterVote", "crashBeforeVote", "crashAfterAck",
+	"crashVoteREQ", "crashPartialPreCommit", "crashPartialCommit"}
+
+// partialFailpoints are the crash points that take the ids of the servers the
+// coordinator still sends the message to before crashing
+//
+// NOTE: without ids, servers crash right away (or ignore the crash point), so
+// tpcctl requires them.
+var partialFailpoints = map[string]bool{
+	"crashVoteREQ": true, "crashPartialPreCommit": true, "crashPartialCommit": true}
+
+// shell runs the commands typed by the user
+type shell struct {
+	client *client.Client
+	out    io.Writer
+	color  bool // print colored output
+
+	coordinator int        // last coordinator the user was told about
+	mutex       sync.Mutex // mutex for accessing coordinator
+}
+
+// run runs the command args and returns true if it succeeded
+func (sh *shell) run(args []string) bool {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		sh.errorf("unknown command: %s (see \"help\")", args[0])
+		return false
+	} else if len(args)-1 < cmd.min {
+		sh.errorf("usage: %s", cmd.usage)
+		return false
+	}
+	return cmd.run(sh, args[1:])
+}
+
+// prompt returns the prompt of the shell, which shows the coordinator
+func (sh *shell) prompt() string {
+	if id := sh.client.Coordinator(); id >= 0 {
+		return fmt.Sprintf("tpcctl (coordinator %d)> ", id)
+	}
+	return "tpcctl (coordinator ?)> "
+}
+
+// follow tells the user about changes of the coordinator until ctx is done
+func (sh *shell) follow(ctx context.Context) {
+	sh.coordinator = sh.client.Coordinator()
+	for event := range sh.client.Watch(ctx) {
+		if event.Kind != "coordinator" {
+			continue
+		}
+		id := sh.client.Coordinator()
+
+		sh.mutex.Lock()
+		changed := id != sh.coordinator
+		sh.coordinator = id
+		sh.mutex.Unlock()
+
+		if changed {
+			fmt.Fprintf(sh.out, "coordinator is now %d\n", id)
+		}
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// commands                                                                  //
+///////////////////////////////////////////////////////////////////////////////
+
+func (sh *shell) add(args []string) bool {
+	txn, err := sh.client.Add(args[0], args[1])
+	return sh.printOutcome(protocol.JoinFields([]string{"add", args[0], args[1]}), txn, err)
+}
+
+func (sh *shell) delete(args []string) bool {
+	txn, err := sh.client.Delete(args[0])
+	return sh.printOutcome(protocol.JoinFields([]string{"delete", args[0]}), txn, err)
+}
+
+func (sh *shell) get(args []string) bool {
+	url, err := sh.client.Get(args[0])
+	if err == client.ErrNotFound {
+		fmt.Fprintf(sh.out, "%s: no such song\n", args[0])
+		return true
+	} else if err != nil {
+		sh.errorf("%v", err)
+		return false
+	}
+	fmt.Fprintf(sh.out, "%s: %s\n", args[0], url)
+	return true
+}
+
+func (sh *shell) status(args []string) bool {
+	w := tabwriter.NewWriter(sh.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVER\tADDRESS\tSTATE\tALIVE")
+	coordinator := sh.client.Coordinator()
+	for _, id := range sh.client.Servers() {
+		state, alive := "up", "-"
+		if reply, err := sh.client.Exec(id, "alive"); err != nil {
+			state = "unreachable"
+		} else {
+			alive = strings.TrimSpace(strings.TrimPrefix(reply, "alive"))
+			if id == coordinator {
+				state = "coordinator"
+			}
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", id, sh.address(id), state, alive)
+	}
+	w.Flush()
+	return true
+}
+
+func (sh *shell) alive(args []string) bool {
+	ids, ok := sh.targets(args, true)
+	if !ok {
+		return false
+	}
+
+	w := tabwriter.NewWriter(sh.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVER\tALIVE\tSUSPICION (PHI)")
+	failed := false
+	for _, id := range ids {
+		reply, err := sh.client.Exec(id, "alive", "phi")
+		if err != nil {
+			fmt.Fprintf(w, "%d\t%s\t\n", id, "unreachable")
+			failed = true
+			continue
+		}
+
+		// "alive <id1>:<phi1>,<id2>:<phi2>,..."
+		for i, entry := range list(strings.TrimPrefix(reply, "alive")) {
+			server := ""
+			if i == 0 {
+				server = strconv.Itoa(id)
+			}
+			parts := strings.SplitN(entry, ":", 2)
+			phi := ""
+			if len(parts) == 2 {
+				phi = parts[1]
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", server, parts[0], phi)
+		}
+	}
+	w.Flush()
+	return !failed
+}
+
+func (sh *shell) crash(args []string) bool {
+	ids, ok := sh.targets(args, false)
+	if !ok {
+		return false
+	}
+
+	// the server exits without replying
+	_, err := sh.client.Exec(ids[0], "crash")
+	if err != nil && !errors.Is(err, io.EOF) {
+		sh.errorf("server %d: %v", ids[0], err)
+		return false
+	}
+	fmt.Fprintf(sh.out, "server %d crashed\n", ids[0])
+	return true
+}
+
+func (sh *shell) failpoint(args []string) bool {
+	ids, ok := sh.targets(args[:1], true)
+	if !ok {
+		return false
+	}
+
+	point := args[1]
+	if point != "" && !strings.HasPrefix(point, "crash") {
+		// e.g. "afterVote" for "crashAfterVote"
+		point = "crash" + strings.ToUpper(point[:1]) + point[1:]
+	}
+	known := false
+	for _, p := range failpoints {
+		known = known || p == point
+	}
+	if !known {
+		sh.errorf("unknown failpoint: %s (one of %s)", args[1], strings.Join(failpoints, ", "))
+		return false
+	} else if partialFailpoints[point] && len(args) < 3 {
+		sh.errorf("%s needs the ids of the servers the coordinator reaches before crashing "+
+			"(e.g. \"failpoint %s %s 1\")", point, args[0], args[1])
+		return false
+	}
+
+	succeeded := true
+	for _, id := range ids {
+		_, err := sh.client.Exec(id, append([]string{point}, args[2:]...)...)
+		if e, ok := err.(*client.ServerError); ok && e.Code == "not-implemented" {
+			sh.errorf("server %d: %s is not implemented by the server", id, point)
+			succeeded = false
+			continue
+		} else if err != nil {
+			sh.errorf("server %d: %v", id, err)
+			succeeded = false
+			continue
+		}
+		fmt.Fprintf(sh.out, "server %d: %s set\n", id, point)
+	}
+	return succeeded
+}
+
+func (sh *shell) dump(args []string) bool {
+	ids, ok := sh.targets(args, true)
+	if !ok {
+		return false
+	}
+
+	succeeded := true
+	for i, id := range ids {
+		if i > 0 {
+			fmt.Fprintln(sh.out)
+		}
+		fmt.Fprintf(sh.out, "server %d (%s)\n", id, sh.address(id))
+
+		for _, section := range []string{"messages", "metrics", "suspicion", "clock"} {
+			reply, err := sh.client.Exec(id, section)
+			if err != nil {
+				sh.errorf("server %d: %v", id, err)
+				succeeded = false
+				break
+			}
+
+			entries := list(strings.TrimPrefix(reply, section))
+			fmt.Fprintf(sh.out, "  %s (%d)\n", section, len(entries))
+			for _, entry := range entries {
+				fmt.Fprintf(sh.out, "    %s\n", entry)
+			}
+		}
+	}
+	return succeeded
+}
+
+func (sh *shell) help(args []string) bool {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w := tabwriter.NewWriter(sh.out, 0, 8, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(w, "%s\t%s\n", commands[name].usage, commands[name].help)
+	}
+	fmt.Fprintf(w, "%s\t%s\n", "exit", "leave (or Ctrl-D)")
+	w.Flush()
+	return true
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// helpers                                                                   //
+///////////////////////////////////////////////////////////////////////////////
+
+// printOutcome prints the outcome of the transaction of an add or delete
+// command
+func (sh *shell) printOutcome(command, txn string, err error) bool {
+	if abort, ok := err.(*client.AbortError); ok {
+		fmt.Fprintf(sh.out, "%s %s (%v)\n", sh.style(BOLD_RED, "abort"), command, abort)
+		return false
+	} else if err != nil {
+		sh.errorf("%v", err)
+		return false
+	}
+	fmt.Fprintf(sh.out, "%s %s (txn %s)\n", sh.style(BOLD_GREEN, "commit"), command, txn)
+	return true
+}
+
+// targets returns the ids of the servers a command is sent to: the one given
+// by args[0], or every server if args is empty or "all" (and all is true)
+func (sh *shell) targets(args []string, all bool) ([]int, bool) {
+	if len(args) == 0 || args[0] == "all" {
+		if !all {
+			sh.errorf("a server id is required")
+			return nil, false
+		}
+		return sh.client.Servers(), true
+	}
+
+	id, err := strconv.Atoi(args[0])
+	if err != nil || sh.address(id) == "" {
+		sh.errorf("unknown server: %s", args[0])
+		return nil, false
+	}
+	return []int{id}, true
+}
+
+// address returns the master-facing address of the server with the given id
+// (or "" if it is unknown)
+func (sh *shell) address(id int) string {
+	return SERVERS[id]
+}
+
+// errorf prints an error message
+func (sh *shell) errorf(format string, args ...interface{}) {
+	fmt.Fprintf(sh.out, "%s %s\n", sh.style(BOLD_RED, "error:"), fmt.Sprintf(format, args...))
+}
+
+// style returns s in the given style if the output is colored
+func (sh *shell) style(style, s string) string {
+	if !sh.color {
+		return s
+	}
+	return style + s + NO_STYLE
+}
+
+// list returns the entries of a comma-separated list in a reply (e.g. "0,1,2")
+func list(s string) []string {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
@@ -0,0 +1,198 @@
+// Tpcctl is an interactive client for a cluster of playlist servers (see
+// src/server), meant to replace netcat sessions with the master-facing ports.
+// It sends requests through the client library (see src/client), so adds and
+// deletes go to the coordinator and are retried if it fails, and it follows
+// the coordinator as it changes.
+//
+// "tpcctl -config [config]" connects to every server in the cluster
+// configuration file [config] (see clusterConfig in src/server), and "tpcctl
+// -config [config] -id [id]" to server [id] only. "tpcctl -server [addr]"
+// connects to the server whose master-facing port is at [addr] instead.
+//
+// Commands are read from the terminal, with line editing and a history of
+// previous commands (kept in ~/.tpcctl_history), or from the remaining
+// arguments, e.g. "tpcctl -config cluster.json add song http://example.com".
+// Run "help" for the list of commands:
+//
+//  ➜  tpcctl -config cluster.json
+//  tpcctl (coordinator 0)> add "my song" http://example.com
+//  commit add "my song" http://example.com (txn 0.0.1792384863933271677)
+//  tpcctl (coordinator 0)> get "my song"
+//  my song: http://example.com
+//  tpcctl (coordinator 0)> crash 0
+//  server 0 crashed
+//  coordinator is now 1
+//  tpcctl (coordinator 1)> status
+//  SERVER  ADDRESS          STATE        ALIVE
+//  0       127.0.0.2:30000  unreachable  -
+//  1       127.0.0.3:30000  coordinator  1,2
+//  2       127.0.0.4:30000  up           1,2
+//
+// NOTE: tpcctl imports the client library (and src/protocol) from src, so it is
+// built with the repository as the GOPATH, like the server, e.g.
+// "GOPATH=$PWD GO111MODULE=off go build -o tpcctl ./src/tpcctl/".
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"client"
+	"protocol"
+)
+
+const (
+	// Constants for printing to the terminal
+	BOLD_RED   = "\033[31;1m"
+	BOLD_GREEN = "\033[32;1m"
+	NO_STYLE   = "\033[0m"
+	ERROR      = "[" + BOLD_RED + "ERROR" + NO_STYLE + "]"
+
+	// Number of commands kept in the history file
+	HISTORY_SIZE = 500
+)
+
+var (
+	CONFIG  string // cluster configuration file
+	ID      = -1   // id of the only server to connect to (all if -1)
+	SERVER  string // address of the only server to connect to
+	NO_EDIT bool   // read commands line by line, without line editing
+
+	SERVERS map[int]string // master-facing addresses of the servers (by id)
+)
+
+// clusterConfig is the part of a cluster configuration file tpcctl needs (see
+// clusterConfig in src/server)
+type clusterConfig struct {
+	Members []struct {
+		Id     int    `json:"id"`
+		Master string `json:"master"` // address of the master-facing port
+	} `json:"members"`
+}
+
+func main() {
+	flag.StringVar(&CONFIG, "config", "",
+		"cluster configuration `file` (see clusterConfig in src/server)")
+	flag.IntVar(&ID, "id", ID,
+		"id of the only server in the configuration file to connect to")
+	flag.StringVar(&SERVER, "server", "",
+		"master-facing `address` of the only server to connect to (instead of -config)")
+	flag.BoolVar(&NO_EDIT, "no-edit", false,
+		"read commands line by line (the default if stdin is not a terminal)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] [command [args]]\n"+
+			"(e.g. \"%[1]s -config cluster.json\" OR \"%[1]s -server localhost:30000 get song\")\n\n",
+			os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var err error
+	if SERVERS, err = loadServers(); err != nil {
+		Fatal(err)
+	} else if len(SERVERS) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	c := client.New(SERVERS)
+	defer c.Close()
+
+	// a single command from the arguments
+	if flag.NArg() > 0 {
+		sh := &shell{client: c, out: os.Stdout}
+		if !sh.run(flag.Args()) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	editor := newLineEditor(os.Stdin, os.Stdout, historyFile())
+	if NO_EDIT {
+		editor.raw = false
+	}
+	sh := &shell{client: c, out: editor, color: editor.terminal}
+	editor.prompt = sh.prompt
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go sh.follow(ctx)
+
+	for {
+		line, err := editor.ReadLine()
+		if err == errInterrupt {
+			continue
+		} else if err == io.EOF {
+			return
+		} else if err != nil {
+			Fatal(err)
+		}
+
+		args, err := protocol.SplitFields(line)
+		if err != nil {
+			sh.errorf("cannot parse command: %v", err)
+			continue
+		} else if len(args) == 0 {
+			continue
+		} else if args[0] == "exit" || args[0] == "quit" {
+			return
+		}
+		sh.run(args)
+	}
+}
+
+// loadServers returns the master-facing addresses of the servers to connect to
+// (by id), as given by -config, -id and -server
+func loadServers() (map[int]string, error) {
+	if SERVER != "" {
+		id := ID
+		if id < 0 {
+			id = 0
+		}
+		return map[int]string{id: SERVER}, nil
+	} else if CONFIG == "" {
+		return nil, nil
+	}
+
+	b, err := ioutil.ReadFile(CONFIG)
+	if err != nil {
+		return nil, err
+	}
+	var config clusterConfig
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("%s: %v", CONFIG, err)
+	}
+
+	servers := make(map[int]string)
+	for _, member := range config.Members {
+		if ID < 0 || member.Id == ID {
+			servers[member.Id] = member.Master
+		}
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("%s: no server with id %d", CONFIG, ID)
+	}
+	return servers, nil
+}
+
+// historyFile returns the path of the file the history of commands is kept in
+// (or "" if there is no home directory)
+func historyFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".tpcctl_history")
+}
+
+// Fatal prints an error message and exits
+func Fatal(err ...interface{}) {
+	log.Fatalln(ERROR + " " + fmt.Sprint(err...))
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// errInterrupt is returned by ReadLine if the user pressed Ctrl-C
+var errInterrupt = errors.New("interrupted")
+
+// Keys understood by the line editor (see ReadLine)
+const (
+	CTRL_A    = 1
+	CTRL_B    = 2
+	CTRL_C    = 3
+	CTRL_D    = 4
+	CTRL_E    = 5
+	CTRL_F    = 6
+	BACKSPACE = 8
+	TAB       = 9
+	CTRL_K    = 11
+	CTRL_L    = 12
+	CTRL_N    = 14
+	CTRL_P    = 16
+	CTRL_U    = 21
+	CTRL_W    = 23
+	ESCAPE    = 27
+	DELETE    = 127
+)
+
+// lineEditor reads commands from a terminal, with readline-style editing:
+//
+//  - Left/Right, Ctrl-B/Ctrl-F:    move the cursor
+//  - Home/End, Ctrl-A/Ctrl-E:      move to the start or end of the line
+//  - Up/Down, Ctrl-P/Ctrl-N:       recall the previous or next command
+//  - Backspace, Delete:            delete the character before or under the
+//                                  cursor
+//  - Ctrl-K, Ctrl-U, Ctrl-W:       delete to the end or start of the line, or
+//                                  the word before the cursor
+//  - Tab:                          complete the name of a command
+//  - Ctrl-L:                       clear the screen
+//  - Ctrl-C:                       discard the line
+//  - Ctrl-D:                       exit (on an empty line)
+//
+// Output written to the editor while a line is being read (e.g. "coordinator
+// is now 1") is printed above the line, which is then redrawn.
+//
+// If the input is not a terminal (or line editing is disabled), lines are read
+// as they are, without a history.
+type lineEditor struct {
+	in       *bufio.Reader
+	out      io.Writer
+	fd       int           // file descriptor of the input
+	terminal bool          // the input is a terminal
+	raw      bool          // use line editing (see makeRaw)
+	prompt   func() string // returns the prompt (see shell.prompt)
+
+	history  []string // previous commands (the most recent last)
+	histFile string   // file the history is kept in ("" for none)
+
+	reading bool   // a line is being read
+	line    []rune // line being read
+	pos     int    // position of the cursor in line
+	mutex   sync.Mutex
+}
+
+// newLineEditor returns a line editor for the given terminal, whose history
+// is kept in histFile
+func newLineEditor(in, out *os.File, histFile string) *lineEditor {
+	e := &lineEditor{
+		in:       bufio.NewReader(in),
+		out:      out,
+		fd:       int(in.Fd()),
+		terminal: isTerminal(int(in.Fd())),
+		histFile: histFile,
+		prompt:   func() string { return "> " },
+	}
+	e.raw = e.terminal
+	e.loadHistory()
+	return e
+}
+
+// ReadLine reads a line (without the trailing newline)
+//
+// Returns errInterrupt if the user pressed Ctrl-C, and io.EOF if the input
+// ended (or the user pressed Ctrl-D on an empty line).
+func (e *lineEditor) ReadLine() (string, error) {
+	if !e.raw {
+		return e.readPlainLine()
+	}
+
+	restore, err := makeRaw(e.fd)
+	if err != nil {
+		e.raw = false
+		return e.readPlainLine()
+	}
+	defer restore()
+
+	// the history being edited, followed by the new line
+	entries := append(append([]string(nil), e.history...), "")
+	current := len(entries) - 1
+
+	e.mutex.Lock()
+	e.reading, e.line, e.pos = true, nil, 0
+	e.refresh()
+	e.mutex.Unlock()
+
+	for {
+		key, seq, err := e.readKey()
+		if err != nil {
+			e.finish("\n")
+			return "", err
+		}
+
+		e.mutex.Lock()
+		switch key {
+		case '\r', '\n':
+			line := string(e.line)
+			e.mutex.Unlock()
+			e.finish("\n")
+			e.addToHistory(line)
+			return line, nil
+		case CTRL_C:
+			e.mutex.Unlock()
+			e.finish("^C\n")
+			return "", errInterrupt
+		case CTRL_D:
+			if len(e.line) == 0 {
+				e.mutex.Unlock()
+				e.finish("\n")
+				return "", io.EOF
+			}
+			e.deleteAt(e.pos)
+		case BACKSPACE, DELETE:
+			if e.pos > 0 {
+				e.pos--
+				e.deleteAt(e.pos)
+			}
+		case CTRL_A:
+			e.pos = 0
+		case CTRL_E:
+			e.pos = len(e.line)
+		case CTRL_B:
+			e.move(-1)
+		case CTRL_F:
+			e.move(1)
+		case CTRL_K:
+			e.line = e.line[:e.pos]
+		case CTRL_U:
+			e.line, e.pos = e.line[e.pos:], 0
+		case CTRL_W:
+			start := e.pos
+			for start > 0 && e.line[start-1] == ' ' {
+				start--
+			}
+			for start > 0 && e.line[start-1] != ' ' {
+				start--
+			}
+			e.line, e.pos = append(e.line[:start], e.line[e.pos:]...), start
+		case CTRL_L:
+			fmt.Fprint(e.out, "\033[H\033[2J")
+		case CTRL_P:
+			current = e.recall(entries, current, -1)
+		case CTRL_N:
+			current = e.recall(entries, current, 1)
+		case TAB:
+			e.complete()
+		case ESCAPE:
+			switch seq {
+			case "[A", "OA":
+				current = e.recall(entries, current, -1)
+			case "[B", "OB":
+				current = e.recall(entries, current, 1)
+			case "[C", "OC":
+				e.move(1)
+			case "[D", "OD":
+				e.move(-1)
+			case "[H", "OH", "[1~", "[7~":
+				e.pos = 0
+			case "[F", "OF", "[4~", "[8~":
+				e.pos = len(e.line)
+			case "[3~":
+				e.deleteAt(e.pos)
+			}
+		default:
+			if key >= ' ' {
+				e.line = append(e.line[:e.pos], append([]rune{key}, e.line[e.pos:]...)...)
+				e.pos++
+			}
+		}
+		e.refresh()
+		e.mutex.Unlock()
+	}
+}
+
+// Write writes p above the line being read (if any)
+func (e *lineEditor) Write(p []byte) (int, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if !e.reading {
+		return e.out.Write(p)
+	}
+	fmt.Fprint(e.out, "\r\033[K")
+	n, err := e.out.Write(p)
+	e.refresh()
+	return n, err
+}
+
+// readPlainLine reads a line without line editing
+func (e *lineEditor) readPlainLine() (string, error) {
+	if e.terminal {
+		fmt.Fprint(e.out, e.prompt())
+	}
+	line, err := e.in.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+// readKey reads a key, along with the rest of the sequence for escape
+// sequences (e.g. "[A" for Up)
+func (e *lineEditor) readKey() (rune, string, error) {
+	key, _, err := e.in.ReadRune()
+	if err != nil || key != ESCAPE {
+		return key, "", err
+	}
+
+	// "ESC [ <params> <final>" or "ESC O <final>"
+	var seq []byte
+	for {
+		b, err := e.in.ReadByte()
+		if err != nil {
+			return key, string(seq), err
+		}
+		seq = append(seq, b)
+		if len(seq) == 1 && b != '[' && b != 'O' {
+			return key, string(seq), nil
+		} else if len(seq) > 1 && b >= 0x40 && b <= 0x7e {
+			return key, string(seq), nil
+		}
+	}
+}
+
+// refresh redraws the prompt and the line being read
+func (e *lineEditor) refresh() {
+	fmt.Fprintf(e.out, "\r%s%s\033[K", e.prompt(), string(e.line))
+	if n := len(e.line) - e.pos; n > 0 {
+		fmt.Fprintf(e.out, "\033[%dD", n)
+	}
+}
+
+// finish stops reading the line and writes s (e.g. "\n") after it
+func (e *lineEditor) finish(s string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.pos = len(e.line)
+	e.refresh()
+	fmt.Fprint(e.out, s)
+	e.reading = false
+}
+
+// move moves the cursor by delta characters
+func (e *lineEditor) move(delta int) {
+	if pos := e.pos + delta; pos >= 0 && pos <= len(e.line) {
+		e.pos = pos
+	}
+}
+
+// deleteAt deletes the character at the given position (if any)
+func (e *lineEditor) deleteAt(pos int) {
+	if pos < len(e.line) {
+		e.line = append(e.line[:pos], e.line[pos+1:]...)
+	}
+}
+
+// recall replaces the line with the entry of the history delta entries away
+// from the current one, keeping the changes made to the current one, and
+// returns the index of the new entry
+func (e *lineEditor) recall(entries []string, current, delta int) int {
+	next := current + delta
+	if next < 0 || next >= len(entries) {
+		return current
+	}
+	entries[current] = string(e.line)
+	e.line = []rune(entries[next])
+	e.pos = len(e.line)
+	return next
+}
+
+// complete completes the name of the command before the cursor, if it is the
+// first word of the line and only one command starts with it
+func (e *lineEditor) complete() {
+	prefix := string(e.line[:e.pos])
+	if strings.ContainsAny(prefix, " \t") {
+		return
+	}
+
+	var matches []string
+	for name := range commands {
+		if strings.HasPrefix(name, prefix) {
+			matches = append(matches, name)
+		}
+	}
+	if len(matches) != 1 {
+		if len(matches) > 1 {
+			sort.Strings(matches)
+			fmt.Fprintf(e.out, "\r\033[K%s\n", strings.Join(matches, "  "))
+		}
+		return
+	}
+
+	completion := []rune(matches[0][len(prefix):] + " ")
+	e.line = append(e.line[:e.pos], append(completion, e.line[e.pos:]...)...)
+	e.pos += len(completion)
+}
+
+// loadHistory reads the history from histFile, keeping the last HISTORY_SIZE
+// commands
+func (e *lineEditor) loadHistory() {
+	if e.histFile == "" {
+		return
+	}
+	b, err := ioutil.ReadFile(e.histFile)
+	if err != nil {
+		return
+	}
+
+	lines := strings.Split(strings.TrimRight(string(b), "\n"), "\n")
+	if len(lines) > HISTORY_SIZE {
+		lines = lines[len(lines)-HISTORY_SIZE:]
+		ioutil.WriteFile(e.histFile, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+	}
+	for _, line := range lines {
+		if line != "" {
+			e.history = append(e.history, line)
+		}
+	}
+}
+
+// addToHistory appends line to the history (and to histFile), unless it is
+// empty or the same as the previous command
+func (e *lineEditor) addToHistory(line string) {
+	if strings.TrimSpace(line) == "" ||
+		(len(e.history) > 0 && e.history[len(e.history)-1] == line) {
+		return
+	}
+	e.history = append(e.history, line)
+	if len(e.history) > HISTORY_SIZE {
+		e.history = e.history[1:]
+	}
+
+	if e.histFile == "" {
+		return
+	}
+	file, err := os.OpenFile(e.histFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	fmt.Fprintln(file, line)
+}
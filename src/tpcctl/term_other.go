@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// isTerminal returns true if fd is a terminal
+//
+// NOTE: line editing is only supported on Linux, so commands are read line by
+// line elsewhere
+func isTerminal(fd int) bool {
+	return false
+}
+
+// makeRaw puts the terminal fd into raw mode (see term_linux.go)
+func makeRaw(fd int) (func(), error) {
+	return nil, errors.New("raw mode is not supported")
+}